@@ -0,0 +1,227 @@
+package gossip
+
+import (
+	"math"
+	"sort"
+)
+
+const (
+	defaultAggregateTolerance = 1e-3
+	defaultAggregateRounds    = 5
+)
+
+// AggregateKind is a function computed over values of all nodes.
+type AggregateKind int
+
+const (
+	AggregateAverage AggregateKind = iota // average of values, by push-flow
+	AggregateCount                        // number of nodes, by push-flow; values are ignored
+	AggregateMin                          // the least value
+	AggregateMax                          // the greatest value
+)
+
+// Estimate is a node's current estimate of an aggregate.
+type Estimate struct {
+	Value float64
+	// Converged tells that the estimate has changed by at most the config's
+	// AggregateTolerance for AggregateRounds rounds.
+	Converged bool
+}
+
+// aggregate is the state of a node for one aggregate. Average and count are
+// computed by push-flow, the loss tolerant push-sum: the node's mass is its
+// initial sum and weight less the flows to its neighbours. Every round the node
+// adds half of its mass to the flow to a random neighbour and sends the whole
+// flow, the neighbour takes the negated flow as its flow back. A lost message
+// is made up for by the next one, so the mass of the net is kept and
+// the estimate sum/weight converges to the average of initial sums
+// if all weights are 1, or to their sum if only one is.
+type aggregate struct {
+	kind   AggregateKind
+	sum    float64 // initial sum, the value for min and max
+	weight float64 // initial weight
+	flows  map[int][2]float64
+	last   float64 // estimate of the previous round
+	stable int     // number of rounds the estimate is within tolerance
+}
+
+// mass returns the sum and weight the node holds.
+func (a *aggregate) mass() (sum, weight float64) {
+	sum, weight = a.sum, a.weight
+	ids := make([]int, 0, len(a.flows))
+	for id := range a.flows {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids) // keep rounding independent of map iteration
+	for _, id := range ids {
+		sum -= a.flows[id][0]
+		weight -= a.flows[id][1]
+	}
+	return sum, weight
+}
+
+func (a *aggregate) estimate() (float64, bool) {
+	switch a.kind {
+	case AggregateMin, AggregateMax:
+		return a.sum, true
+	}
+	sum, weight := a.mass()
+	if weight <= 0 {
+		return 0, false
+	}
+	return sum / weight, true
+}
+
+func (cfg *Config) aggregateTolerance() float64 {
+	if cfg.AggregateTolerance > 0 {
+		return cfg.AggregateTolerance
+	}
+	return defaultAggregateTolerance
+}
+
+func (cfg *Config) aggregateRounds() int {
+	if cfg.AggregateRounds > 0 {
+		return cfg.AggregateRounds
+	}
+	return defaultAggregateRounds
+}
+
+// startAggregate sets the node's initial value and weight of the aggregate.
+func (p *nodeProcessor) startAggregate(name string, kind AggregateKind, value, weight float64) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.aggregates[name] = &aggregate{kind: kind, sum: value, weight: weight, flows: make(map[int][2]float64), last: math.NaN()}
+}
+
+func (p *nodeProcessor) stopAggregate(name string) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	delete(p.aggregates, name)
+}
+
+// aggregateRound sends a share of every aggregate to a random neighbour
+// and checks whether estimates have converged.
+func (p *nodeProcessor) aggregateRound() {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if len(p.aggregates) == 0 {
+		return
+	}
+	names := make([]string, 0, len(p.aggregates))
+	for name := range p.aggregates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	dests := p.getNeighbours()
+	for _, name := range names {
+		a := p.aggregates[name]
+		est, ok := a.estimate()
+		if ok && math.Abs(est-a.last) <= p.cfg.aggregateTolerance()*math.Abs(a.last) {
+			a.stable++
+		} else {
+			a.stable = 0
+		}
+		a.last = est
+		if len(dests) == 0 {
+			continue
+		}
+		to := dests[p.rng.Intn(len(dests))]
+		msg := Message{MsgType: "aggregate", Sender: p.myID, Origin: p.myID, Name: name}
+		switch a.kind {
+		case AggregateMin, AggregateMax:
+			msg.Values = []float64{a.sum}
+		default:
+			sum, weight := a.mass()
+			flow := a.flows[to]
+			flow[0] += sum / 2
+			flow[1] += weight / 2
+			a.flows[to] = flow
+			msg.Values = flow[:]
+		}
+		p.sendTo(to, msg)
+	}
+}
+
+// processAggregate merges a flow or a value of a neighbour into the node's state.
+// A node which doesn't compute the aggregate answers with zero flow,
+// so the mass sent to it returns to the sender.
+func (p *nodeProcessor) processAggregate(msg Message) {
+	a, ok := p.aggregates[msg.Name]
+	if !ok {
+		if len(msg.Values) == 2 && msg.Origin == msg.Sender {
+			back := msg
+			back.Sender = p.myID
+			back.Members = nil
+			back.Values = []float64{0, 0}
+			p.sendTo(msg.Sender, back)
+		}
+		return
+	}
+	switch {
+	case a.kind == AggregateMin && len(msg.Values) == 1:
+		a.sum = math.Min(a.sum, msg.Values[0])
+	case a.kind == AggregateMax && len(msg.Values) == 1:
+		a.sum = math.Max(a.sum, msg.Values[0])
+	case len(msg.Values) == 2:
+		a.flows[msg.Sender] = [2]float64{-msg.Values[0], -msg.Values[1]}
+	}
+}
+
+func (p *nodeProcessor) aggregateEstimate(name string) (Estimate, bool) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	a, ok := p.aggregates[name]
+	if !ok {
+		return Estimate{}, false
+	}
+	est, ok := a.estimate()
+	if !ok {
+		return Estimate{Value: math.NaN()}, true
+	}
+	return Estimate{est, a.stable >= p.cfg.aggregateRounds()}, true
+}
+
+// Aggregate returns the node's estimate of the aggregate with name
+// and whether the node computes it.
+func (gn *GossipNode) Aggregate(name string) (Estimate, bool) {
+	return gn.processor.aggregateEstimate(name)
+}
+
+// StartAggregate starts computing the aggregate with name over values
+// of nodes of the net, value is called with IDs of nodes. For AggregateCount
+// values are ignored. Nodes added to the net later don't take part in it.
+// Lost messages delay convergence of estimates but don't bias them.
+func (GN *GossipNet) StartAggregate(name string, kind AggregateKind, value func(id int) float64) {
+	for i, gn := range GN.nodes {
+		var v, w float64
+		switch kind {
+		case AggregateCount:
+			v = 1
+			if i == 0 { // weight of one node makes sum/weight the number of nodes
+				w = 1
+			}
+		default:
+			v, w = value(gn.id), 1
+		}
+		gn.processor.startAggregate(name, kind, v, w)
+	}
+}
+
+// StopAggregate stops computing the aggregate with name.
+func (GN *GossipNet) StopAggregate(name string) {
+	for _, gn := range GN.nodes {
+		gn.processor.stopAggregate(name)
+	}
+}
+
+// Aggregate returns current estimates of the aggregate with name by nodes
+// which compute it.
+func (GN *GossipNet) Aggregate(name string) map[int]Estimate {
+	res := make(map[int]Estimate)
+	for _, gn := range GN.nodes {
+		if est, ok := gn.Aggregate(name); ok {
+			res[gn.id] = est
+		}
+	}
+	return res
+}
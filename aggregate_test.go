@@ -0,0 +1,43 @@
+package gossip
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestAggregatesConverge(t *testing.T) {
+	const n = 30
+	for _, drop := range []float64{0, 0.1} {
+		GN := InitNet(n, 100*time.Millisecond, WithSimulation(23), withQuietLog(), WithAggregateConvergence(1e-4, 10))
+		if err := GN.Start(""); err != nil {
+			t.Fatal(err)
+		}
+		GN.SetFaults(Faults{Drop: drop})
+		GN.StartAggregate("avg", AggregateAverage, func(id int) float64 { return float64(id) })
+		GN.StartAggregate("count", AggregateCount, nil)
+		GN.StartAggregate("max", AggregateMax, func(id int) float64 { return float64(id) })
+		converged := func() bool {
+			for _, name := range []string{"avg", "count", "max"} {
+				for _, est := range GN.Aggregate(name) {
+					if !est.Converged {
+						return false
+					}
+				}
+			}
+			return true
+		}
+		if !GN.RunUntil(converged, 5*time.Minute) {
+			t.Fatalf("aggregates are not converged with drop %v", drop)
+		}
+		for name, want := range map[string]float64{"avg": (n - 1) / 2.0, "count": n, "max": n - 1} {
+			for id, est := range GN.Aggregate(name) {
+				if math.Abs(est.Value-want) > 0.01*want {
+					t.Errorf("node %d estimates %s as %v with drop %v, want %v", id, name, est.Value, drop, want)
+				}
+			}
+		}
+		GN.Stop(context.Background())
+	}
+}
@@ -0,0 +1,116 @@
+package gossip
+
+const (
+	// defaultDigestSize is the number of message IDs in a digest
+	// if the config doesn't set it.
+	defaultDigestSize = 100
+)
+
+// messageStore keeps recently received messages to send them to
+// neighbours which lack them. The oldest messages are forgotten first.
+type messageStore struct {
+	msgs     map[MsgID]Message
+	order    []MsgID // from the oldest to the newest
+	capacity int
+}
+
+func newMessageStore(capacity int) *messageStore {
+	if capacity <= 0 {
+		capacity = defaultSeenCapacity
+	}
+	return &messageStore{msgs: make(map[MsgID]Message), capacity: capacity}
+}
+
+func (s *messageStore) put(msg Message) {
+	if _, ok := s.msgs[msg.ID]; ok {
+		return
+	}
+	if len(s.order) >= s.capacity {
+		delete(s.msgs, s.order[0])
+		s.order = s.order[1:]
+	}
+	s.msgs[msg.ID] = msg
+	s.order = append(s.order, msg.ID)
+}
+
+func (s *messageStore) get(id MsgID) (Message, bool) {
+	msg, ok := s.msgs[id]
+	return msg, ok
+}
+
+// recent returns IDs of at most n newest messages.
+func (s *messageStore) recent(n int) []MsgID {
+	if n > len(s.order) {
+		n = len(s.order)
+	}
+	res := make([]MsgID, n)
+	copy(res, s.order[len(s.order)-n:])
+	return res
+}
+
+func (p *nodeProcessor) digestSize() int {
+	if p.cfg.DigestSize > 0 {
+		return p.cfg.DigestSize
+	}
+	return defaultDigestSize
+}
+
+// antiEntropy starts an anti-entropy exchange: sends the digest
+// of known messages to a random neighbour.
+func (p *nodeProcessor) antiEntropy() {
+	p.m.Lock()
+	defer p.m.Unlock()
+	dests := p.getNeighbours()
+	if len(dests) == 0 {
+		return
+	}
+	to := dests[p.rng.Intn(len(dests))]
+	p.sendTo(to, Message{
+		MsgType: "digest",
+		Sender:  p.myID,
+		Origin:  p.myID,
+		Digest:  p.store.recent(p.digestSize()),
+	})
+}
+
+// processDigest answers the digest of a neighbour: pulls messages the neighbour
+// knows and this node doesn't and pushes messages the neighbour lacks.
+func (p *nodeProcessor) processDigest(msg Message, curCount int) {
+	known := make(map[MsgID]bool, len(msg.Digest))
+	missing := []MsgID{}
+	for _, id := range msg.Digest {
+		known[id] = true
+		if _, ok := p.store.get(id); !ok && !p.msgIDs.has(seenKey{id, -1}, curCount) {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 {
+		p.sendTo(msg.Sender, Message{
+			MsgType: "pull",
+			Sender:  p.myID,
+			Origin:  p.myID,
+			Digest:  missing,
+		})
+	}
+	for _, id := range p.store.recent(p.digestSize()) {
+		if !known[id] {
+			p.pushStored(msg.Sender, id)
+		}
+	}
+}
+
+// processPull sends requested messages to the neighbour.
+func (p *nodeProcessor) processPull(msg Message) {
+	for _, id := range msg.Digest {
+		p.pushStored(msg.Sender, id)
+	}
+}
+
+func (p *nodeProcessor) pushStored(to int, id MsgID) {
+	stored, ok := p.store.get(id)
+	if !ok {
+		return
+	}
+	stored.Sender = p.myID
+	p.sendTo(to, stored)
+}
@@ -0,0 +1,113 @@
+package gossip
+
+import "math"
+
+// batchFieldSize is the max size of the field header of a message in a binary batch.
+const batchFieldSize = 6
+
+// codec returns the codec messages of the net are encoded with.
+func (cfg *Config) codec() Codec {
+	if cfg.Codec != nil {
+		return cfg.Codec
+	}
+	return BinaryCodec
+}
+
+// wireSize returns the size of msg encoded with codec.
+func wireSize(codec Codec, msg Message) int {
+	b, _ := codec.Encode(msg)
+	return len(b)
+}
+
+// piggybackSize returns the max size of membership updates
+// piggybacked on a datagram encoded with codec.
+func piggybackSize(codec Codec) int {
+	updates := make([]MemberUpdate, maxPiggyback)
+	for i := range updates {
+		updates[i] = MemberUpdate{math.MaxInt64, MemberDead, math.MaxUint64}
+	}
+	return wireSize(codec, Message{Members: updates}) - wireSize(codec, Message{})
+}
+
+// sendAll sends messages of the round or of processing a message. With batching
+// messages to the same neighbour are packed into datagrams of at most the config's
+// MTU, the last one is filled with other queued messages and acks for the neighbour.
+// A message larger than MTU is sent alone.
+func (gn *GossipNode) sendAll(packs []senderPack) {
+	if gn.cfg.MTU <= 0 {
+		for _, pack := range packs {
+			gn.cfg.Logger.Printf("[NODE %d] sending to address %s message %s", gn.id, pack.addr, pack.msg)
+			gn.send(pack.addr, pack.msg)
+		}
+		return
+	}
+	codec := gn.cfg.codec()
+	empty := wireSize(codec, Message{MsgType: "batch", Sender: gn.id, Origin: gn.id})
+	if gn.cfg.ProbeEvery > 0 {
+		empty += piggybackSize(codec)
+	}
+	addrs := []string{}
+	msgs := make(map[string][]Message)
+	for _, pack := range packs {
+		if _, ok := msgs[pack.addr]; !ok {
+			addrs = append(addrs, pack.addr)
+		}
+		msgs[pack.addr] = append(msgs[pack.addr], pack.msg)
+	}
+	for _, addr := range addrs {
+		var batches [][]Message
+		var batch []Message
+		size := empty
+		for _, msg := range msgs[addr] {
+			s := wireSize(codec, msg) + batchFieldSize
+			if len(batch) > 0 && size+s > gn.cfg.MTU {
+				batches = append(batches, batch)
+				batch, size = nil, empty
+			}
+			batch = append(batch, msg)
+			size += s
+		}
+		batch = append(batch, gn.processor.takeFor(addr, func(msg Message) bool {
+			for _, m := range msgs[addr] {
+				if m.ID == msg.ID && m.MsgType == msg.MsgType && m.Origin == msg.Origin {
+					return false // already sent
+				}
+			}
+			s := wireSize(codec, msg) + batchFieldSize
+			if size+s > gn.cfg.MTU {
+				return false
+			}
+			size += s
+			return true
+		})...)
+		for _, batch := range append(batches, batch) {
+			gn.sendBatch(addr, batch)
+		}
+	}
+}
+
+// sendBatch sends messages to addr in one datagram, a single message as is.
+func (gn *GossipNode) sendBatch(addr string, batch []Message) {
+	if len(batch) == 1 {
+		gn.cfg.Logger.Printf("[NODE %d] sending to address %s message %s", gn.id, addr, batch[0])
+		gn.send(addr, batch[0])
+		return
+	}
+	for _, msg := range batch {
+		gn.cfg.Logger.Printf("[NODE %d] sending to address %s in batch message %s", gn.id, addr, msg)
+	}
+	gn.send(addr, Message{MsgType: "batch", Sender: gn.id, Origin: gn.id, Batch: batch})
+}
+
+// takeFor takes queued messages and acks for the neighbour with address addr
+// while fits accepts them. Every taken message counts as sent once.
+func (p *nodeProcessor) takeFor(addr string, fits func(Message) bool) []Message {
+	p.m.Lock()
+	defer p.m.Unlock()
+	for id, a := range p.neighbours {
+		if a == addr {
+			return append(p.msgQueue.takeFor(id, fits), p.ackQueue.takeFor(id, fits)...)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package gossip
+
+import (
+	"strings"
+	"testing"
+)
+
+// recordTransport keeps sent messages.
+type recordTransport struct {
+	sent []Message
+}
+
+func (t *recordTransport) Send(addr string, msg Message) error {
+	t.sent = append(t.sent, msg)
+	return nil
+}
+
+func (t *recordTransport) Recv() <-chan Message { return nil }
+func (t *recordTransport) Errors() <-chan error { return nil }
+func (t *recordTransport) Close() error         { return nil }
+
+func TestBatchesFitMTU(t *testing.T) {
+	for _, codec := range []Codec{BinaryCodec, JSONCodec} {
+		cfg := testConfig()
+		cfg.MTU = 1400
+		cfg.ProbeEvery = 1
+		cfg.Codec = codec
+		gn := newGossipNode(0, BASE_PORT, map[int]string{1: testAddr(1)}, cfg)
+		tr := &recordTransport{}
+		gn.transport, gn.simulated = tr, true
+		for i := 1; i <= 20; i++ {
+			gn.processor.members.updates = append(gn.processor.members.updates, &pendingUpdate{MemberUpdate: MemberUpdate{i, MemberSuspect, uint64(i)}})
+		}
+
+		var packs []senderPack
+		for i := 1; i <= 100; i++ {
+			msg := NewMessage(MsgID{0, uint64(i)}, "multicast", 0, 0, strings.Repeat("x", 300))
+			packs = append(packs, senderPack{msg, testAddr(1)})
+			gn.processor.msgQueue.putMessage(NewMessage(MsgID{2, uint64(i)}, "multicast", 0, 2, "queued"), []int{1}, 1)
+		}
+		gn.sendAll(packs)
+
+		got := 0
+		for _, msg := range tr.sent {
+			if size := wireSize(codec, msg); size > cfg.MTU {
+				t.Fatalf("datagram of %d bytes, MTU is %d", size, cfg.MTU)
+			}
+			if msg.MsgType == "batch" {
+				got += len(msg.Batch)
+			} else {
+				got++
+			}
+		}
+		if got < len(packs) {
+			t.Fatalf("%d messages sent, want at least %d", got, len(packs))
+		}
+	}
+}
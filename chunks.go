@@ -0,0 +1,167 @@
+package gossip
+
+import (
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	defaultMaxMessageSize    = 1 << 20
+	defaultChunkSize         = 1024
+	defaultReassemblyTimeout = 100
+)
+
+// Chunk tells which part of a large message a message carries.
+// Chunks are gossiped as separate messages and the whole message
+// is delivered and acked when a node gets all of them.
+type Chunk struct {
+	Of    MsgID `json:"of"`    // ID of the whole message
+	Index int   `json:"index"` // number of the chunk from zero
+	Count int   `json:"count"` // number of chunks of the message
+}
+
+// partialMessage is a large message which is being reassembled.
+type partialMessage struct {
+	chunks  []string
+	have    []bool
+	got     int
+	started int // round the first chunk was received at
+}
+
+func newPartialMessage(count, round int) *partialMessage {
+	return &partialMessage{chunks: make([]string, count), have: make([]bool, count), started: round}
+}
+
+// add puts the chunk with index i unless it's received already.
+func (part *partialMessage) add(i int, data string) {
+	if !part.have[i] {
+		part.have[i] = true
+		part.chunks[i] = data
+		part.got++
+	}
+}
+
+func (cfg *Config) maxMessageSize() int {
+	if cfg.MaxMessageSize > 0 {
+		return cfg.MaxMessageSize
+	}
+	return defaultMaxMessageSize
+}
+
+func (cfg *Config) chunkSize() int {
+	if cfg.ChunkSize > 0 {
+		return cfg.ChunkSize
+	}
+	return defaultChunkSize
+}
+
+func (cfg *Config) reassemblyTimeout() int {
+	if cfg.ReassemblyTimeout > 0 {
+		return cfg.ReassemblyTimeout
+	}
+	return defaultReassemblyTimeout
+}
+
+// chunkCount returns the number of chunks msg is split into, 1 for small messages.
+func (cfg *Config) chunkCount(msg Message) int {
+	return len(chunkEnds(msg.Data, cfg.chunkSize()))
+}
+
+// chunkEnds returns ends of chunks of at most size bytes data is split into.
+// Chunks are cut on rune boundaries, so each of them is valid UTF-8 and
+// survives JSONCodec, unless data isn't valid UTF-8 or size is less than
+// utf8.UTFMax.
+func chunkEnds(data string, size int) []int {
+	var res []int
+	for start := 0; start < len(data); start = res[len(res)-1] {
+		end := start + size
+		if end >= len(data) {
+			res = append(res, len(data))
+			break
+		}
+		cut := end
+		for cut > start && end-cut < utf8.UTFMax && !utf8.RuneStart(data[cut]) {
+			cut--
+		}
+		if cut > start && utf8.RuneStart(data[cut]) {
+			end = cut
+		}
+		res = append(res, end)
+	}
+	return res
+}
+
+// splitMessage splits Data of msg into chunks with IDs starting from first.
+func splitMessage(msg Message, first MsgID, size int) []Message {
+	ends := chunkEnds(msg.Data, size)
+	res := make([]Message, 0, len(ends))
+	start := 0
+	for i, end := range ends {
+		chunk := NewMessage(MsgID{first.Node, first.Seq + uint64(i)}, msg.MsgType, msg.Sender, msg.Origin, msg.Data[start:end])
+		chunk.Chunk = &Chunk{msg.ID, i, len(ends)}
+		res = append(res, chunk)
+		start = end
+	}
+	return res
+}
+
+// addChunk puts the chunk to the reassembly buffer. It returns the whole
+// message once all its chunks are received. Chunks received before
+// the reassembly expired are taken from the store, as they are seen
+// already and don't come again.
+func (p *nodeProcessor) addChunk(msg Message, round int) (Message, bool) {
+	c := msg.Chunk
+	if !p.validChunk(c) {
+		p.cfg.Logger.Printf("[NODE %d] bad chunk %s of message %s", p.myID, msg.ID, c.Of)
+		return Message{}, false
+	}
+	part, ok := p.partial[c.Of]
+	if !ok {
+		part = newPartialMessage(c.Count, round)
+		p.partial[c.Of] = part
+		first := msg.ID.Seq - uint64(c.Index) // IDs of chunks are consecutive
+		for i := range part.chunks {
+			stored, ok := p.store.get(MsgID{msg.ID.Node, first + uint64(i)})
+			if ok && stored.Chunk != nil && stored.Chunk.Of == c.Of && stored.Chunk.Index == i {
+				part.add(i, stored.Data)
+			}
+		}
+	}
+	if len(part.chunks) != c.Count {
+		return Message{}, false
+	}
+	part.add(c.Index, msg.Data)
+	if part.got < c.Count {
+		return Message{}, false
+	}
+	delete(p.partial, c.Of)
+	return NewMessage(c.Of, msg.MsgType, msg.Sender, msg.Origin, strings.Join(part.chunks, "")), true
+}
+
+// validChunk checks the chunk's index and count.
+func (p *nodeProcessor) validChunk(c *Chunk) bool {
+	maxCount := p.cfg.maxMessageSize()/p.cfg.chunkSize() + 1
+	return c.Count > 0 && c.Count <= maxCount && c.Index >= 0 && c.Index < c.Count
+}
+
+// expireChunks drops messages and CRDT states which are not reassembled in time.
+func (p *nodeProcessor) expireChunks(round int) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	ids := make([]MsgID, 0, len(p.partial))
+	for id := range p.partial {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { // keep the log independent of map iteration
+		return ids[i].Node < ids[j].Node || ids[i].Node == ids[j].Node && ids[i].Seq < ids[j].Seq
+	})
+	for _, id := range ids {
+		part := p.partial[id]
+		if round-part.started >= p.cfg.reassemblyTimeout() {
+			p.cfg.Logger.Printf("[NODE %d] message %s is not reassembled in time: %d of %d chunks", p.myID, id, part.got, len(part.chunks))
+			delete(p.partial, id)
+		}
+	}
+	p.expireStates(round)
+}
@@ -0,0 +1,53 @@
+package gossip
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestChunksAfterExpiry(t *testing.T) {
+	p := testProcessor(1, 0)
+	p.cfg.ChunkSize = 4
+	p.cfg.ReassemblyTimeout = 2
+	whole := NewMessage(MsgID{0, 1}, "multicast", 0, 0, strings.Repeat("ab", 6))
+	chunks := splitMessage(whole, MsgID{0, 2}, p.cfg.ChunkSize)
+
+	p.processMsg(chunks[0], 0)
+	p.expireChunks(5)
+	if len(p.partial) != 0 {
+		t.Fatal("reassembly is not expired")
+	}
+	p.processMsg(chunks[1], 6)
+	p.processMsg(chunks[0], 7) // a duplicate which is dropped
+	p.processMsg(chunks[2], 8)
+	if len(p.inbox) != 1 || p.inbox[0].ID != whole.ID || p.inbox[0].Data != whole.Data {
+		t.Fatalf("delivered %v, want %v", p.inbox, whole)
+	}
+}
+
+func TestChunksOfUnicodeThroughCodecs(t *testing.T) {
+	whole := NewMessage(MsgID{0, 1}, "multicast", 0, 0, "a"+strings.Repeat("é", 700))
+	for _, codec := range []Codec{JSONCodec, BinaryCodec} {
+		p := testProcessor(1, 0)
+		p.cfg.ChunkSize = 64
+		chunks := splitMessage(whole, MsgID{0, 2}, p.cfg.ChunkSize)
+		for i, chunk := range chunks {
+			if len(chunk.Data) > p.cfg.ChunkSize || !utf8.ValidString(chunk.Data) {
+				t.Fatalf("chunk %d of %d bytes is larger than chunk size or cuts a rune", i, len(chunk.Data))
+			}
+			b, err := codec.Encode(chunk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := codec.Decode(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.processMsg(got, 0)
+		}
+		if len(p.inbox) != 1 || p.inbox[0].Data != whole.Data {
+			t.Fatalf("%T delivered %v, want %v", codec, p.inbox, whole)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package gossip
+
+import "time"
+
+// Clock is a source of time for the net. The net uses the wall clock
+// unless it runs in simulation mode, where time is virtual.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// AfterFunc calls f after duration d. Calling stop prevents f from
+	// running, it reports whether f was prevented.
+	AfterFunc(d time.Duration, f func()) (stop func() bool)
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) func() bool {
+	return time.AfterFunc(d, f).Stop
+}
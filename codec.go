@@ -0,0 +1,372 @@
+package gossip
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"strconv"
+)
+
+// Codec encodes messages to datagrams and decodes them back.
+type Codec interface {
+	Encode(msg Message) ([]byte, error)
+	Decode(data []byte) (Message, error)
+}
+
+var (
+	// JSONCodec encodes messages in JSON. It's readable, so it's handy for debugging.
+	JSONCodec Codec = jsonCodec{}
+	// BinaryCodec encodes messages compactly: a header with magic, protocol
+	// version, type and payload length and the payload of tagged fields.
+	BinaryCodec Codec = binaryCodec{}
+)
+
+// decode detects the encoding of data and decodes it
+// with BinaryCodec or JSONCodec, so nodes understand both.
+func decode(data []byte) (Message, error) {
+	if len(data) > 0 && data[0] == '{' {
+		return JSONCodec.Decode(data)
+	}
+	return BinaryCodec.Decode(data)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(msg Message) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func (jsonCodec) Decode(data []byte) (Message, error) {
+	msg := Message{}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return Message{}, &errorString{"malformed packet: " + err.Error()}
+	}
+	return msg, nil
+}
+
+const (
+	binaryMagic0  = 'G'
+	binaryMagic1  = 'S'
+	binaryVersion = 1
+	// binaryHeaderSize is the size of magic, version, type and payload length.
+	binaryHeaderSize = 8
+)
+
+// errUnknownType is returned by BinaryCodec for a message with a type code
+// added by a newer build. Codes are added without bumping binaryVersion,
+// nodes drop such messages quietly.
+var errUnknownType = &errorString{"unknown message type"}
+
+// msgTypes are codes of known message types, other types are sent as strings with code 0.
+// New codes are appended only, so codes of older builds keep their meaning.
+var msgTypes = []string{"", "multicast", "notification", "digest", "pull", "ping", "ping-req", "ping-ack", "batch", "ihave", "graft", "prune",
+	"join", "forward-join", "neighbour", "neighbour-accept", "neighbour-reject", "disconnect", "shuffle", "shuffle-reply",
+	"aggregate", "state-digest", "state-reply", "state-delta",
+	"crdt"}
+
+func msgTypeCode(t string) byte {
+	for code, name := range msgTypes {
+		if name == t && code > 0 {
+			return byte(code)
+		}
+	}
+	return 0
+}
+
+// tags of fields of binary payload
+const (
+	tagIDNode = iota + 1
+	tagIDSeq
+	tagSender
+	tagOrigin
+	tagData
+	tagDigest
+	tagTarget
+	tagMembers
+	tagType // type name if it has no code
+	tagChunk
+	tagBatch // one field per message, each encoded whole
+	tagPeers
+	tagHops
+	tagValues // float64 values, 8 bytes each
+	tagEntries
+	tagState
+	tagName
+	tagVersions
+)
+
+type binaryCodec struct{}
+
+// Encode writes the header and fields of msg as tag, length, value.
+// Integers are varints, empty fields are skipped.
+func (binaryCodec) Encode(msg Message) ([]byte, error) {
+	buf := make([]byte, binaryHeaderSize, binaryHeaderSize+64+len(msg.Data))
+	buf[0], buf[1], buf[2] = binaryMagic0, binaryMagic1, binaryVersion
+	buf[3] = msgTypeCode(msg.MsgType)
+	var tmp [binary.MaxVarintLen64]byte
+	field := func(tag byte, value []byte) {
+		buf = append(buf, tag)
+		buf = binary.AppendUvarint(buf, uint64(len(value)))
+		buf = append(buf, value...)
+	}
+	varint := func(tag byte, v int64) {
+		field(tag, tmp[:binary.PutVarint(tmp[:], v)])
+	}
+	if buf[3] == 0 {
+		field(tagType, []byte(msg.MsgType))
+	}
+	varint(tagIDNode, int64(msg.ID.Node))
+	field(tagIDSeq, tmp[:binary.PutUvarint(tmp[:], msg.ID.Seq)])
+	varint(tagSender, int64(msg.Sender))
+	varint(tagOrigin, int64(msg.Origin))
+	if msg.Data != "" {
+		field(tagData, []byte(msg.Data))
+	}
+	if len(msg.Digest) > 0 {
+		var b []byte
+		for _, id := range msg.Digest {
+			b = binary.AppendVarint(b, int64(id.Node))
+			b = binary.AppendUvarint(b, id.Seq)
+		}
+		field(tagDigest, b)
+	}
+	if msg.Target != 0 {
+		varint(tagTarget, int64(msg.Target))
+	}
+	if len(msg.Members) > 0 {
+		var b []byte
+		for _, u := range msg.Members {
+			b = binary.AppendVarint(b, int64(u.Node))
+			b = binary.AppendUvarint(b, uint64(u.State))
+			b = binary.AppendUvarint(b, u.Incarnation)
+		}
+		field(tagMembers, b)
+	}
+	if msg.Chunk != nil {
+		var b []byte
+		b = binary.AppendVarint(b, int64(msg.Chunk.Of.Node))
+		b = binary.AppendUvarint(b, msg.Chunk.Of.Seq)
+		b = binary.AppendVarint(b, int64(msg.Chunk.Index))
+		b = binary.AppendVarint(b, int64(msg.Chunk.Count))
+		field(tagChunk, b)
+	}
+	if len(msg.Peers) > 0 {
+		var b []byte
+		for _, peer := range msg.Peers {
+			b = binary.AppendVarint(b, int64(peer.ID))
+			b = binary.AppendUvarint(b, uint64(len(peer.Addr)))
+			b = append(b, peer.Addr...)
+		}
+		field(tagPeers, b)
+	}
+	if msg.Hops != 0 {
+		varint(tagHops, int64(msg.Hops))
+	}
+	if len(msg.Entries) > 0 {
+		var b []byte
+		for _, e := range msg.Entries {
+			b = binary.AppendVarint(b, int64(e.Node))
+			b = binary.AppendUvarint(b, e.Version)
+			b = binary.AppendUvarint(b, uint64(len(e.Key)))
+			b = append(b, e.Key...)
+			b = binary.AppendUvarint(b, uint64(len(e.Value)))
+			b = append(b, e.Value...)
+		}
+		field(tagEntries, b)
+	}
+	if len(msg.State) > 0 {
+		field(tagState, msg.State)
+	}
+	if msg.Name != "" {
+		field(tagName, []byte(msg.Name))
+	}
+	if len(msg.Versions) > 0 {
+		var b []byte
+		for _, v := range msg.Versions {
+			b = binary.AppendVarint(b, int64(v.Node))
+			b = binary.AppendUvarint(b, v.Version)
+		}
+		field(tagVersions, b)
+	}
+	if len(msg.Values) > 0 {
+		b := make([]byte, 0, 8*len(msg.Values))
+		for _, v := range msg.Values {
+			b = binary.BigEndian.AppendUint64(b, math.Float64bits(v))
+		}
+		field(tagValues, b)
+	}
+	for _, m := range msg.Batch {
+		b, err := binaryCodec{}.Encode(m)
+		if err != nil {
+			return nil, err
+		}
+		field(tagBatch, b)
+	}
+	binary.BigEndian.PutUint32(buf[4:8], uint32(len(buf)-binaryHeaderSize))
+	return buf, nil
+}
+
+// Decode checks the header and reads fields. Unknown fields are skipped,
+// so newer nodes can add them. Messages of unknown types give errUnknownType,
+// in a batch they are skipped.
+func (binaryCodec) Decode(data []byte) (Message, error) {
+	malformed := func(reason string) (Message, error) {
+		return Message{}, &errorString{"malformed packet: " + reason}
+	}
+	if len(data) < binaryHeaderSize {
+		return malformed("too short")
+	}
+	if data[0] != binaryMagic0 || data[1] != binaryMagic1 {
+		return malformed("bad magic")
+	}
+	if data[2] != binaryVersion {
+		return malformed("unsupported version " + strconv.Itoa(int(data[2])))
+	}
+	if int(data[3]) >= len(msgTypes) {
+		return Message{}, errUnknownType
+	}
+	payload := data[binaryHeaderSize:]
+	if uint64(binary.BigEndian.Uint32(data[4:8])) != uint64(len(payload)) {
+		return malformed("bad length")
+	}
+	msg := Message{MsgType: msgTypes[data[3]]}
+	for len(payload) > 0 {
+		tag := payload[0]
+		size, n := binary.Uvarint(payload[1:])
+		if n <= 0 || size > uint64(len(payload)-1-n) {
+			return malformed("bad field length")
+		}
+		value := payload[1+n : 1+n+int(size)]
+		payload = payload[1+n+int(size):]
+		ok := true
+		switch tag {
+		case tagType:
+			msg.MsgType = string(value)
+		case tagIDNode:
+			msg.ID.Node, ok = readInt(value)
+		case tagIDSeq:
+			var k int
+			msg.ID.Seq, k = binary.Uvarint(value)
+			ok = k == len(value)
+		case tagSender:
+			msg.Sender, ok = readInt(value)
+		case tagOrigin:
+			msg.Origin, ok = readInt(value)
+		case tagData:
+			msg.Data = string(value)
+		case tagTarget:
+			msg.Target, ok = readInt(value)
+		case tagDigest:
+			r := varintReader{value, true}
+			for len(r.b) > 0 && r.ok {
+				id := MsgID{int(r.varint()), r.uvarint()}
+				msg.Digest = append(msg.Digest, id)
+			}
+			ok = r.ok
+		case tagMembers:
+			r := varintReader{value, true}
+			for len(r.b) > 0 && r.ok {
+				u := MemberUpdate{int(r.varint()), MemberState(r.uvarint()), r.uvarint()}
+				msg.Members = append(msg.Members, u)
+			}
+			ok = r.ok
+		case tagPeers:
+			r := varintReader{value, true}
+			for len(r.b) > 0 && r.ok {
+				peer := Peer{ID: int(r.varint())}
+				peer.Addr, ok = r.bytes()
+				msg.Peers = append(msg.Peers, peer)
+				r.ok = r.ok && ok
+			}
+			ok = r.ok
+		case tagHops:
+			msg.Hops, ok = readInt(value)
+		case tagEntries:
+			r := varintReader{value, true}
+			for len(r.b) > 0 && r.ok {
+				e := StateEntry{Node: int(r.varint()), Version: r.uvarint()}
+				e.Key, _ = r.bytes()
+				e.Value, _ = r.bytes()
+				msg.Entries = append(msg.Entries, e)
+			}
+			ok = r.ok
+		case tagState:
+			msg.State = append([]byte(nil), value...)
+		case tagName:
+			msg.Name = string(value)
+		case tagVersions:
+			r := varintReader{value, true}
+			for len(r.b) > 0 && r.ok {
+				v := StateVersion{int(r.varint()), r.uvarint()}
+				msg.Versions = append(msg.Versions, v)
+			}
+			ok = r.ok
+		case tagValues:
+			ok = len(value)%8 == 0
+			for i := 0; ok && i < len(value); i += 8 {
+				msg.Values = append(msg.Values, math.Float64frombits(binary.BigEndian.Uint64(value[i:])))
+			}
+		case tagBatch:
+			m, err := binaryCodec{}.Decode(value)
+			if err == errUnknownType {
+				break
+			}
+			if err != nil {
+				return Message{}, err
+			}
+			msg.Batch = append(msg.Batch, m)
+		case tagChunk:
+			r := varintReader{value, true}
+			msg.Chunk = &Chunk{MsgID{int(r.varint()), r.uvarint()}, int(r.varint()), int(r.varint())}
+			ok = r.ok && len(r.b) == 0
+		}
+		if !ok {
+			return malformed("bad field " + strconv.Itoa(int(tag)))
+		}
+	}
+	return msg, nil
+}
+
+// varintReader reads varints one by one, ok is false after a failed read.
+type varintReader struct {
+	b  []byte
+	ok bool
+}
+
+func (r *varintReader) varint() int64 {
+	v, n := binary.Varint(r.b)
+	if n <= 0 {
+		r.ok = false
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *varintReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.ok = false
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+// bytes reads a string prefixed with its length.
+func (r *varintReader) bytes() (string, bool) {
+	n := r.uvarint()
+	if !r.ok || n > uint64(len(r.b)) {
+		r.ok = false
+		return "", false
+	}
+	s := string(r.b[:n])
+	r.b = r.b[n:]
+	return s, true
+}
+
+// readInt reads a field which is a single varint.
+func readInt(value []byte) (int, bool) {
+	v, n := binary.Varint(value)
+	return int(v), n > 0 && n == len(value)
+}
@@ -0,0 +1,41 @@
+package gossip
+
+import "testing"
+
+func TestDecodeUnknownType(t *testing.T) {
+	known := NewMessage(MsgID{1, 2}, "multicast", 1, 1, "hello")
+	b, _ := BinaryCodec.Encode(known)
+	b[3] = byte(len(msgTypes)) // a type of a newer build
+	if _, err := BinaryCodec.Decode(b); err != errUnknownType {
+		t.Fatalf("decoding unknown type gives %v, want errUnknownType", err)
+	}
+
+	batch, _ := BinaryCodec.Encode(Message{MsgType: "batch", Batch: []Message{known, known}})
+	// the first message of the batch follows fields of the batch, a tag and a length
+	head, _ := BinaryCodec.Encode(Message{MsgType: "batch"})
+	batch[len(head)+2+3] = byte(len(msgTypes))
+	msg, err := BinaryCodec.Decode(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Batch) != 1 || msg.Batch[0].ID != known.ID || msg.Batch[0].Data != known.Data {
+		t.Fatalf("batch decoded to %v, want only %v", msg.Batch, known)
+	}
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	msg := Message{MsgType: "state-reply", Sender: 3, Origin: 3, Name: "hits",
+		Versions: []StateVersion{{1, 7}, {4, 2}},
+		Entries:  []StateEntry{{1, "load", "0.7", 7}}}
+	b, err := BinaryCodec.Encode(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := BinaryCodec.Decode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != msg.String() || len(got.Versions) != 2 || got.Versions[1] != msg.Versions[1] || got.Entries[0] != msg.Entries[0] {
+		t.Fatalf("decoded %v, want %v", got, msg)
+	}
+}
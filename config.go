@@ -0,0 +1,344 @@
+package gossip
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+// PausePolicy tells what a paused node does with received messages.
+type PausePolicy int
+
+const (
+	PauseBuffer PausePolicy = iota // keep messages until the node continues
+	PauseDrop                      // lose messages as if they were not delivered
+)
+
+// PeerSelection tells how a node chooses the message it sends every round
+// and neighbours it sends the message to.
+type PeerSelection int
+
+const (
+	SelectRandom      PeerSelection = iota // random message to random neighbours
+	SelectRoundRobin                       // neighbours of a message in turn, none gets it twice before all got it
+	SelectUnsentFirst                      // random message to neighbours it was sent to the least times
+	SelectByAge                            // message weighted by remaining TTL, so new ones are sent more often
+)
+
+// Config holds parameters of a net. Every net has its own config,
+// so several nets can run in one process independently.
+type Config struct {
+	TTL      int           // number of times a node sends every message, nothing is gossiped if it is not positive
+	Interval time.Duration // duration of a round
+	Host     string        // host nodes bind to
+	BasePort int           // port of the first node of a generated net
+	// Logger is the session logger. If it is nil, the net opens
+	// a session log in the log directory on Start.
+	Logger *log.Logger
+	// OnAcked is called when a message made by node is acked by all nodes.
+	// rounds is the number of rounds passed since the message was made.
+	// It's called from the node's goroutine on the round or receipt after
+	// the message is completed, with no locks of the node held, so it may
+	// call methods of the node and the net. It must not block.
+	OnAcked func(node int, msgID MsgID, rounds int)
+	// Fanout is the number of neighbours a node sends a message to every round.
+	// Every send counts against TTL. Zero means 1.
+	Fanout int
+	// PeerSelection tells how the message and its recipients are chosen every round.
+	PeerSelection PeerSelection
+	// PausePolicy tells what paused nodes do with received messages.
+	PausePolicy PausePolicy
+	// SeenCapacity is the max number of message IDs (and the same of acks)
+	// a node remembers to drop duplicates. The oldest are forgotten first.
+	// Zero means 10000.
+	SeenCapacity int
+	// SeenExpiry is the number of rounds after which a node forgets
+	// a message ID. It should be much greater than TTL. Zero means never.
+	SeenExpiry int
+	// SeenBloom makes nodes remember message IDs in Bloom filters
+	// which take less memory but rarely take new messages for duplicates.
+	SeenBloom bool
+	// AntiEntropyEvery is the period in rounds of anti-entropy: a node sends
+	// the digest of known messages to a random neighbour, pulls messages it lacks
+	// and pushes messages the neighbour lacks. It works alongside rumour mongering
+	// and lets nodes which missed every push recover. Zero disables anti-entropy.
+	AntiEntropyEvery int
+	// DigestSize is the max number of the newest message IDs in a digest.
+	// Zero means 100.
+	DigestSize int
+	// ProbeEvery is the period in rounds of the failure detector: a node pings
+	// a neighbour and if it doesn't answer directly or through IndirectProbes
+	// other neighbours, suspects it. A neighbour suspected for SuspectTimeout rounds
+	// is declared dead and nothing is sent to it. Zero disables failure detection.
+	ProbeEvery int
+	// ProbeTimeout is the number of rounds to wait for the ack of ping
+	// before asking other neighbours. Zero means 1.
+	ProbeTimeout int
+	// IndirectProbes is the number of neighbours asked to ping a node
+	// which didn't answer. Zero means 3.
+	IndirectProbes int
+	// SuspectTimeout is the number of rounds a node stays suspected
+	// before it's declared dead. Zero means 5.
+	SuspectTimeout int
+	// OnMemberChange is called when a node changes its view of another node.
+	// Like OnAcked it's called from the node's goroutine with no locks
+	// of the node held and must not block.
+	OnMemberChange func(ev MemberEvent)
+	// MaxMessageSize is the max size of Data of a message. Zero means 1 MiB.
+	MaxMessageSize int
+	// ChunkSize is the max size of Data sent in one datagram, larger messages
+	// are split into chunks which are gossiped independently and reassembled
+	// by every node before delivery. Chunks are cut on rune boundaries,
+	// so they may be up to 3 bytes shorter. Zero means 1024.
+	ChunkSize int
+	// ReassemblyTimeout is the number of rounds a node waits for all chunks
+	// of a large message before it drops the received ones. Zero means 100.
+	ReassemblyTimeout int
+	// ShuffleEvery is the period in rounds of shuffles of HyParView peer
+	// sampling. If it's set, neighbours of a node are its active view of at
+	// most ActiveViewSize peers, failed neighbours are replaced by peers of its
+	// passive view of at most PassiveViewSize peers, and passive views are
+	// refreshed by shuffles. New nodes join through contact nodes. Failures are
+	// found by the failure detector, see ProbeEvery. Zero disables peer sampling.
+	ShuffleEvery int
+	// ActiveViewSize is the max number of neighbours with peer sampling. Zero means 5.
+	ActiveViewSize int
+	// PassiveViewSize is the max number of passive peers. Zero means 30.
+	PassiveViewSize int
+	// Plumtree makes nodes disseminate multicast messages with Plumtree instead
+	// of sending them TTL times: a message is pushed once along a spanning tree
+	// of the graph and announced by ID to all neighbours. A node which
+	// gets a message twice prunes the link it came by, a node which doesn't get
+	// an announced message in GraftTimeout rounds grafts the announcing
+	// neighbour into the tree. Acks are sent as usual.
+	Plumtree bool
+	// GraftTimeout is the number of rounds to wait for an announced message
+	// before asking the neighbour which announced it. Zero means 2.
+	GraftTimeout int
+	// StateEvery is the period in rounds of reconciliation of replicated
+	// key-value state with a random neighbour. Zero means 1.
+	StateEvery int
+	// DeltaSize is the max number of state entries sent in a message. Zero means 100.
+	// Entries of a message take at most ChunkSize bytes.
+	DeltaSize int
+	// AggregateTolerance is the max relative change of an aggregate estimate
+	// in a round for which the estimate is stable. Zero means 0.001.
+	AggregateTolerance float64
+	// AggregateRounds is the number of rounds an estimate has to be stable
+	// to be converged. Zero means 5.
+	AggregateRounds int
+	// MTU is the max size of a datagram with several messages. If it's set,
+	// messages and acks queued for the same neighbour are packed together,
+	// so fewer datagrams are sent. Zero disables batching.
+	MTU int
+	// Codec encodes messages sent over UDP. Nil means BinaryCodec.
+	// Nodes decode both binary and JSON messages, so nodes with
+	// different codecs understand each other.
+	Codec Codec
+	// OnError is called with *NodeError when a node fails to receive
+	// or send a message. Nodes keep working after such errors.
+	OnError func(err error)
+}
+
+// DefaultConfig returns the config nets are constructed with.
+func DefaultConfig() Config {
+	return Config{
+		TTL:      10,
+		Interval: 100 * time.Millisecond,
+		Host:     "127.0.0.1",
+		BasePort: BASE_PORT,
+	}
+}
+
+// stderrLogger is used by nodes which are not part of a net.
+var stderrLogger = log.New(os.Stderr, "TRACE:", log.Ltime)
+
+// Option customizes a GossipNet on construction.
+type Option func(*GossipNet)
+
+// WithConfig replaces the whole config of the net.
+func WithConfig(cfg Config) Option {
+	return func(GN *GossipNet) {
+		GN.cfg = cfg
+	}
+}
+
+// WithTTL sets TTL of messages of the net.
+func WithTTL(ttl int) Option {
+	return func(GN *GossipNet) {
+		GN.cfg.TTL = ttl
+	}
+}
+
+// WithHost sets the host nodes of the net bind to.
+func WithHost(host string) Option {
+	return func(GN *GossipNet) {
+		GN.cfg.Host = host
+	}
+}
+
+// WithBasePort sets the port of the first node of a net made by InitNet.
+func WithBasePort(port int) Option {
+	return func(GN *GossipNet) {
+		GN.cfg.BasePort = port
+	}
+}
+
+// WithFanout makes nodes send a message to fanout neighbours every round,
+// choosing them with selection.
+func WithFanout(fanout int, selection PeerSelection) Option {
+	return func(GN *GossipNet) {
+		GN.cfg.Fanout = fanout
+		GN.cfg.PeerSelection = selection
+	}
+}
+
+// WithLogger makes the net write the session log to logger
+// instead of a file in the log directory.
+func WithLogger(logger *log.Logger) Option {
+	return func(GN *GossipNet) {
+		GN.cfg.Logger = logger
+	}
+}
+
+// WithAckHook sets the function called when a message is acked by all nodes.
+func WithAckHook(f func(node int, msgID MsgID, rounds int)) Option {
+	return func(GN *GossipNet) {
+		GN.cfg.OnAcked = f
+	}
+}
+
+// WithPausePolicy sets what paused nodes of the net do with received messages.
+func WithPausePolicy(policy PausePolicy) Option {
+	return func(GN *GossipNet) {
+		GN.cfg.PausePolicy = policy
+	}
+}
+
+// WithSeenCache sets capacity and expiry in rounds of caches of already
+// received messages and whether they are Bloom filters.
+func WithSeenCache(capacity, expiry int, bloom bool) Option {
+	return func(GN *GossipNet) {
+		GN.cfg.SeenCapacity = capacity
+		GN.cfg.SeenExpiry = expiry
+		GN.cfg.SeenBloom = bloom
+	}
+}
+
+// WithAntiEntropy enables anti-entropy every given number of rounds.
+func WithAntiEntropy(every int) Option {
+	return func(GN *GossipNet) {
+		GN.cfg.AntiEntropyEvery = every
+	}
+}
+
+// WithMembership enables the failure detector with given probe period,
+// number of indirect probes and suspicion timeout in rounds.
+func WithMembership(probeEvery, indirectProbes, suspectTimeout int) Option {
+	return func(GN *GossipNet) {
+		GN.cfg.ProbeEvery = probeEvery
+		GN.cfg.IndirectProbes = indirectProbes
+		GN.cfg.SuspectTimeout = suspectTimeout
+	}
+}
+
+// WithMemberHook sets the function called on membership changes.
+func WithMemberHook(f func(ev MemberEvent)) Option {
+	return func(GN *GossipNet) {
+		GN.cfg.OnMemberChange = f
+	}
+}
+
+// WithErrorHook sets the function called on I/O errors of nodes.
+func WithErrorHook(f func(err error)) Option {
+	return func(GN *GossipNet) {
+		GN.cfg.OnError = f
+	}
+}
+
+// WithMessageSize sets the max size of messages, the size of chunks
+// large messages are split into and the reassembly timeout in rounds.
+func WithMessageSize(maxSize, chunkSize, reassemblyTimeout int) Option {
+	return func(GN *GossipNet) {
+		GN.cfg.MaxMessageSize = maxSize
+		GN.cfg.ChunkSize = chunkSize
+		GN.cfg.ReassemblyTimeout = reassemblyTimeout
+	}
+}
+
+// WithPeerSampling enables HyParView peer sampling with given view sizes
+// and shuffle period in rounds.
+func WithPeerSampling(activeSize, passiveSize, shuffleEvery int) Option {
+	return func(GN *GossipNet) {
+		GN.cfg.ActiveViewSize = activeSize
+		GN.cfg.PassiveViewSize = passiveSize
+		GN.cfg.ShuffleEvery = shuffleEvery
+	}
+}
+
+// WithPlumtree makes nodes disseminate messages with Plumtree
+// with given graft timeout in rounds.
+func WithPlumtree(graftTimeout int) Option {
+	return func(GN *GossipNet) {
+		GN.cfg.Plumtree = true
+		GN.cfg.GraftTimeout = graftTimeout
+	}
+}
+
+// WithStateSync sets the period in rounds of reconciliation of replicated
+// state and the max number of entries sent in a message.
+func WithStateSync(every, deltaSize int) Option {
+	return func(GN *GossipNet) {
+		GN.cfg.StateEvery = every
+		GN.cfg.DeltaSize = deltaSize
+	}
+}
+
+// WithAggregateConvergence sets when estimates of aggregates are converged:
+// they change by at most tolerance, relatively, for the given number of rounds.
+func WithAggregateConvergence(tolerance float64, rounds int) Option {
+	return func(GN *GossipNet) {
+		GN.cfg.AggregateTolerance = tolerance
+		GN.cfg.AggregateRounds = rounds
+	}
+}
+
+// WithBatching makes nodes pack messages for the same neighbour
+// into datagrams of at most mtu bytes.
+func WithBatching(mtu int) Option {
+	return func(GN *GossipNet) {
+		GN.cfg.MTU = mtu
+	}
+}
+
+// WithCodec makes nodes of the net encode messages sent over UDP with codec,
+// e.g. JSONCodec to read them in a packet sniffer.
+func WithCodec(codec Codec) Option {
+	return func(GN *GossipNet) {
+		GN.cfg.Codec = codec
+	}
+}
+
+// WithTransport makes nodes of the net open their transports with f.
+func WithTransport(f TransportFactory) Option {
+	return func(GN *GossipNet) {
+		GN.newTransport = f
+	}
+}
+
+// WithMemTransport makes nodes of the net exchange messages over channels
+// of a private MemNetwork, so no ports are used.
+func WithMemTransport() Option {
+	return WithTransport(NewMemNetwork().Listen)
+}
+
+// WithSimulation makes the net run in simulation mode: rounds advance on
+// a virtual clock, messages are delivered by a simulated transport and all
+// randomness comes from seed. Nodes do not run on their own, the simulation
+// is driven by Advance and RunUntil calls. Runs with the same seed are identical.
+func WithSimulation(seed int64) Option {
+	return func(GN *GossipNet) {
+		GN.sim = newSimulator(seed)
+		GN.seed = seed
+	}
+}
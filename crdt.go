@@ -0,0 +1,448 @@
+package gossip
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// CRDT is a replica of a convergent replicated data type. Nodes gossip states
+// of their replicas and merge received states into local ones, so replicas
+// converge whatever messages are lost, duplicated or reordered.
+// Methods of replicas are safe for concurrent use.
+type CRDT interface {
+	// State returns the encoded state of the replica.
+	State() []byte
+	// Merge merges the encoded state of another replica into the replica.
+	Merge(state []byte) error
+}
+
+// GCounter is a grow-only counter.
+type GCounter struct {
+	node   int
+	counts map[int]uint64 // map[nodeID]increments made by the node
+	m      sync.Mutex
+}
+
+// NewGCounter constructs a replica of a grow-only counter of the node with id.
+func NewGCounter(id int) *GCounter {
+	return &GCounter{node: id, counts: make(map[int]uint64)}
+}
+
+// Increment adds n to the counter.
+func (c *GCounter) Increment(n uint64) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.counts[c.node] += n
+}
+
+// Value returns the sum of increments of all replicas known to the replica.
+func (c *GCounter) Value() uint64 {
+	c.m.Lock()
+	defer c.m.Unlock()
+	var sum uint64
+	for _, n := range c.counts {
+		sum += n
+	}
+	return sum
+}
+
+func (c *GCounter) State() []byte {
+	c.m.Lock()
+	defer c.m.Unlock()
+	b, _ := json.Marshal(c.counts)
+	return b
+}
+
+func (c *GCounter) Merge(state []byte) error {
+	counts := map[int]uint64{}
+	if err := json.Unmarshal(state, &counts); err != nil {
+		return err
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	for id, n := range counts {
+		if n > c.counts[id] {
+			c.counts[id] = n
+		}
+	}
+	return nil
+}
+
+// PNCounter is a counter which can be incremented and decremented.
+// It's a pair of grow-only counters of increments and decrements.
+type PNCounter struct {
+	p, n *GCounter
+}
+
+// NewPNCounter constructs a replica of a counter of the node with id.
+func NewPNCounter(id int) *PNCounter {
+	return &PNCounter{NewGCounter(id), NewGCounter(id)}
+}
+
+// Add adds delta to the counter.
+func (c *PNCounter) Add(delta int64) {
+	if delta >= 0 {
+		c.p.Increment(uint64(delta))
+	} else {
+		c.n.Increment(uint64(-delta))
+	}
+}
+
+// Value returns the value of the counter.
+func (c *PNCounter) Value() int64 {
+	return int64(c.p.Value()) - int64(c.n.Value())
+}
+
+type pnState struct {
+	P json.RawMessage `json:"p"`
+	N json.RawMessage `json:"n"`
+}
+
+func (c *PNCounter) State() []byte {
+	b, _ := json.Marshal(pnState{c.p.State(), c.n.State()})
+	return b
+}
+
+func (c *PNCounter) Merge(state []byte) error {
+	var s pnState
+	if err := json.Unmarshal(state, &s); err != nil {
+		return err
+	}
+	if err := c.p.Merge(s.P); err != nil {
+		return err
+	}
+	return c.n.Merge(s.N)
+}
+
+// LWWRegister is a register where the last write wins. Writes are ordered
+// by Lamport timestamps, concurrent writes by IDs of nodes.
+type LWWRegister struct {
+	node int
+	s    lwwState
+	m    sync.Mutex
+}
+
+type lwwState struct {
+	Value string `json:"value"`
+	Time  uint64 `json:"time"`
+	Node  int    `json:"node"` // node which wrote the value
+}
+
+// NewLWWRegister constructs a replica of a register of the node with id.
+func NewLWWRegister(id int) *LWWRegister {
+	return &LWWRegister{node: id}
+}
+
+// Set writes value to the register. It wins over all values the replica has seen.
+func (r *LWWRegister) Set(value string) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.s = lwwState{value, r.s.Time + 1, r.node}
+}
+
+// Get returns the value of the register.
+func (r *LWWRegister) Get() string {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.s.Value
+}
+
+func (r *LWWRegister) State() []byte {
+	r.m.Lock()
+	defer r.m.Unlock()
+	b, _ := json.Marshal(r.s)
+	return b
+}
+
+func (r *LWWRegister) Merge(state []byte) error {
+	var s lwwState
+	if err := json.Unmarshal(state, &s); err != nil {
+		return err
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	if s.Time > r.s.Time || s.Time == r.s.Time && s.Node > r.s.Node {
+		r.s = s
+	}
+	return nil
+}
+
+// ORSet is an observed-remove set: an element is in the set if it has
+// an add which is not removed. A remove removes only adds the replica has seen,
+// so a concurrent add wins. Instead of keeping tombstones of removed adds
+// replicas keep the number of adds they have seen of every replica: an add
+// which is seen but absent is removed.
+type ORSet struct {
+	node int
+	adds map[orTag]string // map[unique tag of an add]element, without removed ones
+	seen map[int]uint64   // map[nodeID]number of adds of the node seen by the replica
+	m    sync.Mutex
+}
+
+type orTag struct {
+	Node int    `json:"node"`
+	Seq  uint64 `json:"seq"`
+}
+
+type orEntry struct {
+	orTag
+	Elem string `json:"elem"`
+}
+
+type orState struct {
+	Adds []orEntry      `json:"adds"`
+	Seen map[int]uint64 `json:"seen"`
+}
+
+// NewORSet constructs a replica of a set of the node with id.
+func NewORSet(id int) *ORSet {
+	return &ORSet{node: id, adds: make(map[orTag]string), seen: make(map[int]uint64)}
+}
+
+// Add adds elem to the set.
+func (s *ORSet) Add(elem string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.seen[s.node]++
+	s.adds[orTag{s.node, s.seen[s.node]}] = elem
+}
+
+// Remove removes elem from the set.
+func (s *ORSet) Remove(elem string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for tag, e := range s.adds {
+		if e == elem {
+			delete(s.adds, tag)
+		}
+	}
+}
+
+// Contains reports whether elem is in the set.
+func (s *ORSet) Contains(elem string) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for _, e := range s.adds {
+		if e == elem {
+			return true
+		}
+	}
+	return false
+}
+
+// Elements returns sorted elements of the set.
+func (s *ORSet) Elements() []string {
+	s.m.Lock()
+	defer s.m.Unlock()
+	set := map[string]bool{}
+	for _, e := range s.adds {
+		set[e] = true
+	}
+	res := make([]string, 0, len(set))
+	for e := range set {
+		res = append(res, e)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// State encodes adds and numbers of seen adds.
+func (s *ORSet) State() []byte {
+	s.m.Lock()
+	defer s.m.Unlock()
+	entries := make([]orEntry, 0, len(s.adds))
+	for tag, e := range s.adds {
+		entries = append(entries, orEntry{orTag: tag, Elem: e})
+	}
+	sort.Slice(entries, func(i, j int) bool { // keep the state independent of map iteration
+		return entries[i].Node < entries[j].Node || entries[i].Node == entries[j].Node && entries[i].Seq < entries[j].Seq
+	})
+	b, _ := json.Marshal(orState{entries, s.seen})
+	return b
+}
+
+// Merge keeps adds both replicas have and adds one replica hasn't seen yet.
+// An add one replica has seen but lacks is removed.
+func (s *ORSet) Merge(state []byte) error {
+	var other orState
+	if err := json.Unmarshal(state, &other); err != nil {
+		return err
+	}
+	adds := make(map[orTag]string, len(other.Adds))
+	for _, e := range other.Adds {
+		adds[e.orTag] = e.Elem
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	for tag := range s.adds {
+		if _, ok := adds[tag]; !ok && tag.Seq <= other.Seen[tag.Node] {
+			delete(s.adds, tag)
+		}
+	}
+	for tag, e := range adds {
+		if tag.Seq > s.seen[tag.Node] {
+			s.adds[tag] = e
+		}
+	}
+	for id, n := range other.Seen {
+		if n > s.seen[id] {
+			s.seen[id] = n
+		}
+	}
+	return nil
+}
+
+// stateKey identifies a replica whose state is reassembled from chunks:
+// the node which sent it and the name of the replica.
+type stateKey struct {
+	node int
+	name string
+}
+
+// partialState is a state of a replica which is being reassembled.
+// Chunks of a state carry its hash as ID, so chunks of the same
+// state sent in different rounds fill in lost ones.
+type partialState struct {
+	*partialMessage
+	of MsgID
+}
+
+// registerCRDT adds the replica to the node's registry.
+func (p *nodeProcessor) registerCRDT(name string, replica CRDT) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.crdts[name] = replica
+}
+
+func (p *nodeProcessor) getCRDT(name string) CRDT {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.crdts[name]
+}
+
+// crdtRound sends states of all replicas to a random neighbour.
+// States larger than the config's ChunkSize are sent in chunks.
+func (p *nodeProcessor) crdtRound() {
+	p.m.Lock()
+	defer p.m.Unlock()
+	dests := p.getNeighbours()
+	if len(p.crdts) == 0 || len(dests) == 0 {
+		return
+	}
+	names := make([]string, 0, len(p.crdts))
+	for name := range p.crdts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	to := dests[p.rng.Intn(len(dests))]
+	size := p.cfg.chunkSize()
+	for _, name := range names {
+		state := p.crdts[name].State()
+		if len(state) > p.cfg.maxMessageSize() {
+			p.cfg.Logger.Printf("[NODE %d] state of %s is too large: %d bytes", p.myID, name, len(state))
+			continue
+		}
+		if len(state) <= size {
+			p.sendTo(to, Message{MsgType: "crdt", Sender: p.myID, Origin: p.myID, Name: name, State: state})
+			continue
+		}
+		h := fnv.New64a()
+		h.Write([]byte(name))
+		h.Write(state)
+		of := MsgID{p.myID, h.Sum64()}
+		count := (len(state) + size - 1) / size
+		for i := 0; i < count; i++ {
+			end := (i + 1) * size
+			if end > len(state) {
+				end = len(state)
+			}
+			p.sendTo(to, Message{MsgType: "crdt", Sender: p.myID, Origin: p.myID, Name: name,
+				State: state[i*size : end], Chunk: &Chunk{of, i, count}})
+		}
+	}
+}
+
+// processCRDT merges the received state into the local replica. Unlike
+// rumours states are neither deduplicated nor forwarded: merging is
+// idempotent and the merged state is sent further in next rounds.
+// A chunk of a state is merged when the whole state is reassembled.
+func (p *nodeProcessor) processCRDT(msg Message, round int) {
+	replica, ok := p.crdts[msg.Name]
+	if !ok {
+		return
+	}
+	state := msg.State
+	if msg.Chunk != nil {
+		if state, ok = p.addStateChunk(msg, round); !ok {
+			return
+		}
+	}
+	if err := replica.Merge(state); err != nil {
+		p.cfg.Logger.Printf("[NODE %d] bad state of %s: %v", p.myID, msg.Name, err)
+	}
+}
+
+// addStateChunk puts the chunk of a state to the reassembly buffer of its
+// replica and returns the whole state once all its chunks are received.
+// Only the latest state of a replica from a node is reassembled.
+func (p *nodeProcessor) addStateChunk(msg Message, round int) ([]byte, bool) {
+	c := msg.Chunk
+	if !p.validChunk(c) {
+		p.cfg.Logger.Printf("[NODE %d] bad chunk of state of %s", p.myID, msg.Name)
+		return nil, false
+	}
+	key := stateKey{msg.Sender, msg.Name}
+	part, ok := p.states[key]
+	if !ok || part.of != c.Of || len(part.chunks) != c.Count {
+		part = &partialState{newPartialMessage(c.Count, round), c.Of}
+		p.states[key] = part
+	}
+	part.add(c.Index, string(msg.State))
+	if part.got < c.Count {
+		return nil, false
+	}
+	delete(p.states, key)
+	return []byte(strings.Join(part.chunks, "")), true
+}
+
+// expireStates drops states which are not reassembled in time, p.m has to be locked.
+func (p *nodeProcessor) expireStates(round int) {
+	keys := make([]stateKey, 0, len(p.states))
+	for key := range p.states {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { // keep the log independent of map iteration
+		return keys[i].node < keys[j].node || keys[i].node == keys[j].node && keys[i].name < keys[j].name
+	})
+	for _, key := range keys {
+		part := p.states[key]
+		if round-part.started >= p.cfg.reassemblyTimeout() {
+			p.cfg.Logger.Printf("[NODE %d] state of %s from node %d is not reassembled in time: %d of %d chunks", p.myID, key.name, key.node, part.got, len(part.chunks))
+			delete(p.states, key)
+		}
+	}
+}
+
+// RegisterCRDT makes the node replicate replica under name. Replicas with
+// the same name on other nodes have to be of the same type.
+func (gn *GossipNode) RegisterCRDT(name string, replica CRDT) {
+	gn.processor.registerCRDT(name, replica)
+}
+
+// CRDT returns the node's replica registered under name or nil.
+func (gn *GossipNode) CRDT(name string) CRDT {
+	return gn.processor.getCRDT(name)
+}
+
+// RegisterCRDT registers replicas made by newReplica for IDs of nodes
+// under name on all nodes of the net, e.g.
+//
+//	GN.RegisterCRDT("hits", func(id int) CRDT { return NewGCounter(id) })
+func (GN *GossipNet) RegisterCRDT(name string, newReplica func(id int) CRDT) {
+	for _, gn := range GN.nodes {
+		gn.RegisterCRDT(name, newReplica(gn.id))
+	}
+}
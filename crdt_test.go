@@ -0,0 +1,98 @@
+package gossip
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLargeStateInChunks(t *testing.T) {
+	p0, p1 := testProcessor(0, 1), testProcessor(1, 0)
+	s0, s1 := NewORSet(0), NewORSet(1)
+	p0.registerCRDT("set", s0)
+	p1.registerCRDT("set", s1)
+	for i := 0; i < 3000; i++ {
+		s1.Add("element" + strconv.Itoa(i))
+	}
+	for i := 0; i < 3000; i += 2 {
+		s1.Remove("element" + strconv.Itoa(i))
+	}
+
+	p1.crdtRound()
+	packs := p1.takeOutbox()
+	if len(packs) < 2 {
+		t.Fatalf("state is sent in %d messages", len(packs))
+	}
+	p1.rng.Shuffle(len(packs), func(i, j int) { packs[i], packs[j] = packs[j], packs[i] })
+	for _, pack := range packs[1:] { // the first chunk is lost
+		if len(pack.msg.State) > p1.cfg.chunkSize() {
+			t.Fatalf("chunk of %d bytes, chunk size is %d", len(pack.msg.State), p1.cfg.chunkSize())
+		}
+		p0.processMsg(pack.msg, 0)
+	}
+	if len(s0.Elements()) != 0 {
+		t.Fatal("state is merged without a chunk")
+	}
+	p1.crdtRound() // the same state again fills in the lost chunk
+	for _, pack := range p1.takeOutbox() {
+		if pack.msg.Chunk.Index == packs[0].msg.Chunk.Index {
+			p0.processMsg(pack.msg, 1)
+		}
+	}
+	if got := s0.Elements(); len(got) != 1500 || s0.Contains("element0") || !s0.Contains("element1") {
+		t.Fatalf("replica has %d elements, want 1500 odd ones", len(got))
+	}
+}
+
+func TestCRDTsConvergeUnderFaults(t *testing.T) {
+	GN := InitNet(8, 100*time.Millisecond, WithSimulation(7), withQuietLog())
+	if err := GN.Start(""); err != nil {
+		t.Fatal(err)
+	}
+	defer GN.Stop(context.Background())
+	GN.SetFaults(Faults{Drop: 0.2, Duplicate: 0.2, Reorder: 0.3, ReorderDelay: 300 * time.Millisecond})
+	GN.RegisterCRDT("g", func(id int) CRDT { return NewGCounter(id) })
+	GN.RegisterCRDT("pn", func(id int) CRDT { return NewPNCounter(id) })
+	GN.RegisterCRDT("lww", func(id int) CRDT { return NewLWWRegister(id) })
+	GN.RegisterCRDT("set", func(id int) CRDT { return NewORSet(id) })
+
+	sum := uint64(0)
+	for _, gn := range GN.nodes {
+		sum += uint64(gn.id + 1)
+		gn.CRDT("g").(*GCounter).Increment(uint64(gn.id + 1))
+		gn.CRDT("pn").(*PNCounter).Add(int64(gn.id) - 4)
+		gn.CRDT("lww").(*LWWRegister).Set("node" + strconv.Itoa(gn.id))
+		gn.CRDT("set").(*ORSet).Add("a")
+		gn.CRDT("set").(*ORSet).Add("node" + strconv.Itoa(gn.id))
+	}
+	GN.Advance(time.Second)
+	for _, gn := range GN.nodes[:4] { // concurrently with adds of other nodes
+		gn.CRDT("set").(*ORSet).Remove("a")
+		gn.CRDT("set").(*ORSet).Remove("node" + strconv.Itoa(gn.id))
+		gn.CRDT("lww").(*LWWRegister).Set("later" + strconv.Itoa(gn.id))
+	}
+	GN.Advance(30 * time.Second)
+
+	values := map[string]func(CRDT) string{
+		"g":   func(c CRDT) string { return strconv.FormatUint(c.(*GCounter).Value(), 10) },
+		"pn":  func(c CRDT) string { return strconv.FormatInt(c.(*PNCounter).Value(), 10) },
+		"lww": func(c CRDT) string { return c.(*LWWRegister).Get() },
+		"set": func(c CRDT) string { return strings.Join(c.(*ORSet).Elements(), " ") },
+	}
+	for name, value := range values {
+		want := value(GN.nodes[0].CRDT(name))
+		for _, gn := range GN.nodes[1:] {
+			if got := value(gn.CRDT(name)); got != want {
+				t.Fatalf("replica %s of node %d is %q, of node 0 is %q", name, gn.id, got, want)
+			}
+		}
+	}
+	if v := GN.nodes[0].CRDT("g").(*GCounter).Value(); v != sum {
+		t.Fatalf("counter is %d, want %d", v, sum)
+	}
+	if set := GN.nodes[0].CRDT("set").(*ORSet); set.Contains("node0") || !set.Contains("node7") {
+		t.Fatalf("set is %v", set.Elements())
+	}
+}
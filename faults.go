@@ -0,0 +1,144 @@
+package gossip
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultReorderDelay bounds the extra delay of reordered messages
+	// if Faults.ReorderDelay is not set.
+	defaultReorderDelay = 10 * time.Millisecond
+)
+
+// Faults describes misbehaviour of a link between nodes.
+// Probabilities are in [0, 1], zero value is a faultless link.
+type Faults struct {
+	Drop         float64       // probability to lose a message
+	Duplicate    float64       // probability to deliver a message twice
+	Delay        time.Duration // delay of every message
+	Reorder      float64       // probability to delay a message for random time, so later ones overtake it
+	ReorderDelay time.Duration // max extra delay of reordered messages
+}
+
+type link struct {
+	from, to string // addresses of nodes
+}
+
+// faultRules are faults of the whole net shared by nodes' transports.
+type faultRules struct {
+	global Faults
+	links  map[link]Faults // overrides global faults for the link
+	m      sync.RWMutex
+}
+
+func newFaultRules() *faultRules {
+	return &faultRules{links: make(map[link]Faults)}
+}
+
+func (r *faultRules) get(from, to string) Faults {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	if f, ok := r.links[link{from, to}]; ok {
+		return f
+	}
+	return r.global
+}
+
+// faultTransport wraps a node's transport and injects faults
+// into outgoing messages according to the rules.
+type faultTransport struct {
+	Transport
+	addr    string
+	rules   *faultRules
+	clock   Clock
+	rng     *rand.Rand
+	pending map[uint64]func() bool // stops of delayed sends by their numbers
+	next    uint64                 // number of the next delayed send
+	closed  bool
+	m       sync.Mutex // guards delayed sends against Close
+}
+
+func newFaultTransport(t Transport, addr string, rules *faultRules, clock Clock, seed int64) *faultTransport {
+	return &faultTransport{
+		Transport: t,
+		addr:      addr,
+		rules:     rules,
+		clock:     clock,
+		rng:       rand.New(rand.NewSource(seed)),
+		pending:   make(map[uint64]func() bool),
+	}
+}
+
+// Stats returns counters of the wrapped transport.
+func (t *faultTransport) Stats() TransportStats {
+	if st, ok := t.Transport.(statsTransport); ok {
+		return st.Stats()
+	}
+	return TransportStats{}
+}
+
+// Send drops, duplicates and delays msg before sending it with the wrapped transport.
+func (t *faultTransport) Send(addr string, msg Message) error {
+	f := t.rules.get(t.addr, addr)
+	if f == (Faults{}) {
+		return t.Transport.Send(addr, msg)
+	}
+	if t.rng.Float64() < f.Drop {
+		return nil
+	}
+	copies := 1
+	if t.rng.Float64() < f.Duplicate {
+		copies = 2
+	}
+	var err error
+	for i := 0; i < copies; i++ {
+		delay := f.Delay
+		if t.rng.Float64() < f.Reorder {
+			maxDelay := f.ReorderDelay
+			if maxDelay == 0 {
+				maxDelay = defaultReorderDelay
+			}
+			delay += time.Duration(t.rng.Int63n(int64(maxDelay)) + 1)
+		}
+		if delay == 0 {
+			err = t.Transport.Send(addr, msg)
+			continue
+		}
+		t.sendLater(delay, addr, msg)
+	}
+	return err
+}
+
+// sendLater sends msg after delay unless the transport is closed before.
+func (t *faultTransport) sendLater(delay time.Duration, addr string, msg Message) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if t.closed {
+		return
+	}
+	n := t.next
+	t.next++
+	t.pending[n] = t.clock.AfterFunc(delay, func() {
+		t.m.Lock()
+		defer t.m.Unlock()
+		if t.closed {
+			return
+		}
+		delete(t.pending, n)
+		t.Transport.Send(addr, msg)
+	})
+}
+
+// Close drops delayed messages which are not sent yet and closes the wrapped transport.
+func (t *faultTransport) Close() error {
+	t.m.Lock()
+	t.closed = true
+	for _, stop := range t.pending {
+		stop()
+	}
+	t.pending = nil
+	t.m.Unlock()
+	return t.Transport.Close()
+}
@@ -0,0 +1,76 @@
+package gossip
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestFaultTransport(t *testing.T) {
+	const n = 5000
+	sim := newSimulator(1)
+	arrivals := map[string]map[uint64][]time.Duration{}
+	for _, addr := range []string{"a", "b", "c"} {
+		if _, err := sim.Listen(addr); err != nil {
+			t.Fatal(err)
+		}
+		addr := addr
+		arrivals[addr] = map[uint64][]time.Duration{}
+		sim.handlers[addr] = func(msg Message) {
+			arrivals[addr][msg.ID.Seq] = append(arrivals[addr][msg.ID.Seq], sim.now)
+		}
+	}
+	rules := newFaultRules()
+	rules.global = Faults{Drop: 0.3, Duplicate: 0.2, Delay: 50 * time.Millisecond}
+	rules.links[link{"a", "c"}] = Faults{Delay: 20 * time.Millisecond} // overrides global faults
+	ft := newFaultTransport(sim.peers["a"], "a", rules, sim, 1)
+	for i := 0; i < n; i++ {
+		for _, to := range []string{"b", "c"} {
+			if err := ft.Send(to, NewMessage(MsgID{0, uint64(i)}, "multicast", 0, 0, "hello")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for sim.step(math.MaxInt64) {
+	}
+
+	near := func(got, want float64) bool { return math.Abs(got-want) < 0.03 }
+	copies := 0
+	for _, at := range arrivals["b"] {
+		copies += len(at)
+		for _, d := range at {
+			if d != 50*time.Millisecond+simLatency {
+				t.Fatalf("message arrived at %v, want %v", d, 50*time.Millisecond+simLatency)
+			}
+		}
+	}
+	if drop := 1 - float64(len(arrivals["b"]))/n; !near(drop, 0.3) {
+		t.Fatalf("drop rate is %.3f, want 0.3", drop)
+	}
+	if dup := float64(copies)/float64(len(arrivals["b"])) - 1; !near(dup, 0.2) {
+		t.Fatalf("duplicate rate is %.3f, want 0.2", dup)
+	}
+	if len(arrivals["c"]) != n {
+		t.Fatalf("%d of %d messages arrived by the faultless link", len(arrivals["c"]), n)
+	}
+	for _, at := range arrivals["c"] {
+		if len(at) != 1 || at[0] != 20*time.Millisecond+simLatency {
+			t.Fatalf("link faults don't override global ones: message arrived at %v", at)
+		}
+	}
+
+	delete(arrivals["b"], 0)
+	rules.global.Drop = 0
+	ft.Send("b", NewMessage(MsgID{0, 0}, "multicast", 0, 0, "hello"))
+	if len(ft.pending) == 0 {
+		t.Fatal("no delayed message is pending")
+	}
+	if err := ft.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for sim.step(math.MaxInt64) {
+	}
+	if at := arrivals["b"][0]; len(at) != 0 {
+		t.Fatalf("delayed message arrived at %v after the transport is closed", at)
+	}
+}
@@ -1,12 +1,13 @@
 package gossip
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"net"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -18,76 +19,186 @@ const (
 	BASE_PORT = 9080
 )
 
-var (
-	logger   *log.Logger
-	logfile  *os.File
-	testMode bool
-	feedback chan int
-	TTL int
-)
-
 // GossipNode represents one gossip net peer.
-// It works with UDP connection using internal sender and receiver.
+// It works with a Transport using internal sender and receiver.
 type GossipNode struct {
-	id        int
-	port      int
-	udpConn   *net.UDPConn
-	receiver  *Receiver
-	sender    *Sender
-	processor *nodeProcessor
-	counter   int
-	m         sync.Mutex
+	id           int
+	port         int
+	newTransport TransportFactory
+	transport    Transport
+	receiver     *Receiver
+	sender       *Sender
+	processor    *nodeProcessor
+	counter      int
+	seq          uint64 // sequence number of the last message generated by the node
+	clock        Clock
+	simulated    bool    // messages go to transport directly, not through sender
+	cfg          *Config // config of the node's net
+	paused       bool
+	pending      []Message  // messages received while paused
+	work         sync.Mutex // held while the node processes a message or a round
+	m            sync.Mutex
+	cancel       context.CancelFunc // stops processing started by the net
+	stopped      chan struct{}      // closed when processing started by the net returns
+	err          error              // the result of processing started by the net
+	stopSim      func()             // stops rounds of the node in simulation mode
+	subscribers  []func(Message)
+	watchers     []func(StateEntry)
+	stats        TransportStats // counters of closed transports
 }
 
 // NewGossipNode constracts new GossipNode based on its graph place.
+// The node communicates over UDP unless other transport is set with UseTransport.
+// It has default config and logs to stderr.
 func NewGossipNode(id int, port int, neighs []graph.Node) *GossipNode {
+	cfg := DefaultConfig()
+	cfg.Logger = stderrLogger
+	return newGossipNode(id, port, graphNeighbours(neighs, cfg.Host), &cfg)
+}
+
+func newGossipNode(id int, port int, neighs map[int]string, cfg *Config) *GossipNode {
+	processor := newNodeProcessor(id, neighs, cfg)
+	processor.addr = nodeAddr(cfg.Host, port)
 	return &GossipNode{
-		id:        id,
-		port:      port,
-		udpConn:   nil,
-		receiver:  nil,
-		sender:    nil,
-		processor: newNodeProcessor(id, neighs),
-		counter:   0,
+		id:           id,
+		port:         port,
+		newTransport: NewUDPTransport,
+		transport:    nil,
+		receiver:     nil,
+		sender:       nil,
+		processor:    processor,
+		counter:      0,
+		clock:        realClock{},
+		cfg:          cfg,
 	}
 }
 
-// Bind creates a socket on the loopback interface with this node's port
-// and assosiates sender and receiver with this UDP connection.
-func (gn *GossipNode) Bind() {
-	laddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(gn.port)))
+// UseTransport sets the factory the node opens its transport with on Bind.
+func (gn *GossipNode) UseTransport(f TransportFactory) {
+	gn.newTransport = f
+}
+
+// Bind opens the node's transport on its address
+// and assosiates sender and receiver with it.
+func (gn *GossipNode) Bind() error {
+	t, err := gn.newTransport(nodeAddr(gn.cfg.Host, gn.port))
 	if err != nil {
-		logger.Println(time.Now().String(), "NODE", gn.id, "ERROR: cannot resolve address")
+		gn.cfg.Logger.Println(gn.clock.Now().String(), "NODE", gn.id, "ERROR: cannot bind port")
+		return &NodeError{gn.id, "bind", err}
+	}
+	gn.transport = t
+	gn.cfg.Logger.Printf("[NODE %d] port binded", gn.id)
+	gn.receiver = NewReceiver(t)
+	gn.sender = NewSender(t)
+	return nil
+}
+
+// Unbind closes the node's transport
+func (gn *GossipNode) Unbind() error {
+	if gn.transport == nil {
+		return nil
+	}
+	err := gn.transport.Close()
+	if st, ok := gn.transport.(statsTransport); ok {
+		gn.stats.add(st.Stats())
 	}
-	conn, err := net.ListenUDP("udp", laddr)
+	gn.transport = nil
+	gn.cfg.Logger.Printf("[NODE %d] port unbinded", gn.id)
 	if err != nil {
-		logger.Println(time.Now().String(), "NODE", gn.id, "ERROR: cannot bind port")
+		return &NodeError{gn.id, "close", err}
 	}
-	gn.udpConn = conn
-	logger.Printf("[NODE %d] port binded", gn.id)
-	gn.receiver = NewReceiver(conn)
-	gn.sender = NewSender(conn)
+	return nil
 }
 
-// Unbind closes socket
-func (gn *GossipNode) Unbind() {
-	gn.udpConn.Close()
-	logger.Printf("[NODE %d] port unbinded", gn.id)
+// reportError logs an I/O error of the node and passes it to the config's OnError.
+func (gn *GossipNode) reportError(op string, err error) {
+	gn.cfg.Logger.Printf("[NODE %d] ERROR: %s: %v", gn.id, op, err)
+	if gn.cfg.OnError != nil {
+		gn.cfg.OnError(&NodeError{gn.id, op, err})
+	}
 }
 
-func (gn *GossipNode) putNewRumour(msg Message, netSize int) (exists bool) {
-	// give a command to processor to put message in the queue and start tracking it
+// putNewRumour gives the message a new ID of the node and gives a command
+// to processor to put message in the queue and start tracking it.
+// The message is tracked until all nodes acked it.
+// Large messages are split into chunks which get the next IDs.
+func (gn *GossipNode) putNewRumour(msg Message) *Rumour {
+	count := gn.cfg.chunkCount(msg)
 	gn.m.Lock()
 	c := gn.counter
+	gn.seq++
+	msg.ID = MsgID{gn.id, gn.seq}
+	if count > 1 {
+		gn.seq += uint64(count)
+	}
 	gn.m.Unlock()
-	return gn.processor.initNewMessage(msg, netSize, c)
+	msg.Sender = gn.id
+	msg.Origin = gn.id
+	var chunks []Message
+	if count > 1 {
+		chunks = splitMessage(msg, MsgID{gn.id, msg.ID.Seq + 1}, gn.cfg.chunkSize())
+	}
+	r := newRumour(msg.ID, gn.processor, gn.clock)
+	gn.processor.initNewMessage(msg, chunks, c, r)
+	return r
+}
+
+// Subscribe makes the node call f with every new multicast message it gets,
+// including messages it makes. f is called once per message unless the node
+// forgets the message ID (see Config.SeenCapacity and Config.SeenExpiry).
+// f is called from the node's goroutine, one message at a time, and must not block.
+// It may pause the node.
+func (gn *GossipNode) Subscribe(f func(Message)) {
+	gn.m.Lock()
+	gn.subscribers = append(gn.subscribers, f)
+	gn.m.Unlock()
+}
+
+// deliver hands new messages to subscribers.
+func (gn *GossipNode) deliver(msgs []Message) {
+	if len(msgs) == 0 {
+		return
+	}
+	gn.m.Lock()
+	subscribers := gn.subscribers
+	gn.m.Unlock()
+	for _, msg := range msgs {
+		gn.cfg.Logger.Printf("[NODE %d] message delivered %s", gn.id, msg.ID)
+		for _, f := range subscribers {
+			f(msg)
+		}
+	}
+}
+
+// TransportStats returns counters of the node's transports, including closed ones,
+// or zeros if the transport doesn't count.
+func (gn *GossipNode) TransportStats() TransportStats {
+	s := gn.stats
+	if st, ok := gn.transport.(statsTransport); ok {
+		s.add(st.Stats())
+	}
+	return s
+}
+
+// ID returns the node's ID.
+func (gn *GossipNode) ID() int {
+	return gn.id
 }
 
 // Process sends messages to random peers every interval and processes incoming messages
-func (gn *GossipNode) Process(kill chan struct{}, interval time.Duration) {
-	logger.Printf("[NODE %d] started processing", gn.id)
-	gn.Bind()
-	defer gn.Unbind()
+// until ctx is done. It binds the node unless it's already bound. It returns after
+// the node's sender and receiver have stopped and the transport is closed,
+// with the error of binding or closing.
+func (gn *GossipNode) Process(ctx context.Context, interval time.Duration) (err error) {
+	gn.cfg.Logger.Printf("[NODE %d] started processing", gn.id)
+	if gn.transport == nil {
+		if err := gn.Bind(); err != nil {
+			return err
+		}
+	}
+	defer func() {
+		err = gn.Unbind()
+	}()
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 	gn.receiver.Start()
@@ -96,77 +207,274 @@ func (gn *GossipNode) Process(kill chan struct{}, interval time.Duration) {
 	defer gn.sender.Stop()
 	for {
 		select {
-		case <-kill: // got stop signal
-			return
+		case <-ctx.Done(): // got stop signal
+			return nil
 		case msg := <-gn.receiver.C: // got some message from receiver
-			logger.Printf("[NODE %d] message received %s", gn.id, msg.String())
-			gn.processor.processMsg(msg, gn.counter)
+			gn.handle(msg)
+		case err := <-gn.receiver.Err:
+			gn.reportError("receive", err)
+		case err := <-gn.sender.Err:
+			gn.reportError("send", err)
 		case <-ticker.C: // time for new round
-			gn.m.Lock()
-			gn.counter++
-			gn.m.Unlock()
-			msg, addr, empty := gn.processor.getRandomMsg()
-			if !empty {
-				logger.Printf("[NODE %d] sending to address %s message %s", gn.id, addr, msg)
-				gn.sender.C <- senderPack{msg, addr} // sending task for node's sender
-			}
-			msg, addr, empty = gn.processor.getRandomAck()
-			if !empty {
-				logger.Printf("[NODE %d] sending to address %s ack %s", gn.id, addr, msg)
-				gn.sender.C <- senderPack{msg, addr}
-			}
+			gn.tick()
 		}
 	}
 }
 
+// simulate is Process for simulation mode: instead of running a loop
+// the node registers its rounds and receipts as events of sim.
+func (gn *GossipNode) simulate(sim *simulator, interval time.Duration) error {
+	gn.cfg.Logger.Printf("[NODE %d] started processing", gn.id)
+	gn.clock = sim
+	gn.simulated = true
+	if err := gn.Bind(); err != nil {
+		return err
+	}
+	sim.handlers[nodeAddr(gn.cfg.Host, gn.port)] = gn.handle
+	gn.stopSim = sim.every(time.Duration(sim.rng.Int63n(int64(interval))), interval, gn.tick)
+	return nil
+}
+
+// round returns the number of the node's current round.
+func (gn *GossipNode) round() int {
+	gn.m.Lock()
+	defer gn.m.Unlock()
+	return gn.counter
+}
+
+// handle processes a message received by the node after messages buffered
+// during a pause. Messages received while the node is paused are buffered
+// or dropped. New messages are delivered and hooks are called after
+// the node's work is done, so they may call methods of the node.
+func (gn *GossipNode) handle(msg Message) {
+	gn.work.Lock()
+	if gn.paused {
+		if gn.cfg.PausePolicy == PauseBuffer {
+			gn.pending = append(gn.pending, msg)
+		}
+		gn.work.Unlock()
+		return
+	}
+	gn.receive(append(gn.takePending(), msg))
+	gn.flush()
+	res := gn.processor.takeResults()
+	gn.work.Unlock()
+	gn.dispatch(res)
+}
+
+// takePending returns messages buffered during a pause, gn.work has to be locked.
+func (gn *GossipNode) takePending() []Message {
+	res := gn.pending
+	gn.pending = nil
+	return res
+}
+
+// receive processes received messages, gn.work has to be locked.
+func (gn *GossipNode) receive(msgs []Message) {
+	for _, msg := range msgs {
+		gn.cfg.Logger.Printf("[NODE %d] message received %s", gn.id, msg.String())
+		gn.processor.processMsg(msg, gn.counter)
+	}
+}
+
+// tick makes a new round: sends random message and random ack to random peers.
+// Rounds are skipped while the node is paused. Messages buffered during
+// the pause are processed before the first round after it.
+func (gn *GossipNode) tick() {
+	gn.work.Lock()
+	if gn.paused {
+		gn.work.Unlock()
+		return
+	}
+	gn.receive(gn.takePending())
+	gn.m.Lock()
+	gn.counter++
+	gn.m.Unlock()
+	packs := gn.processor.getRoundMessages()
+	if gn.cfg.AntiEntropyEvery > 0 && gn.counter%gn.cfg.AntiEntropyEvery == 0 {
+		gn.processor.antiEntropy()
+	}
+	if gn.cfg.ProbeEvery > 0 {
+		gn.processor.probeRound(gn.counter)
+	}
+	if gn.cfg.Plumtree {
+		gn.processor.treeRound(gn.counter)
+	}
+	if gn.cfg.ShuffleEvery > 0 {
+		gn.processor.samplingRound(gn.counter)
+	}
+	gn.processor.aggregateRound()
+	if gn.counter%gn.cfg.stateEvery() == 0 {
+		gn.processor.stateRound()
+	}
+	gn.processor.crdtRound()
+	gn.processor.expireChunks(gn.counter)
+	gn.sendAll(append(packs, gn.processor.takeOutbox()...))
+	res := gn.processor.takeResults()
+	gn.work.Unlock()
+	gn.dispatch(res)
+}
+
+// dispatch hands results of processing to the application: delivers messages,
+// notifies watchers and calls hooks. It's called with no locks of the node held.
+func (gn *GossipNode) dispatch(res results) {
+	for _, ev := range res.events {
+		gn.cfg.OnMemberChange(ev)
+	}
+	gn.deliver(res.inbox)
+	gn.notify(res.changes)
+	for _, a := range res.acked {
+		gn.cfg.OnAcked(gn.id, a.id, a.rounds)
+	}
+}
+
+// flush sends messages the processor put to its outbox.
+func (gn *GossipNode) flush() {
+	gn.sendAll(gn.processor.takeOutbox())
+}
+
+// CacheStats returns metrics of the node's caches of already received messages.
+func (gn *GossipNode) CacheStats() CacheStats {
+	return gn.processor.cacheStats()
+}
+
+// Members returns the node's view of the net: states of its neighbours
+// and of other nodes it has heard about.
+func (gn *GossipNode) Members() map[int]MemberState {
+	return gn.processor.membersView()
+}
+
+// Views returns the node's neighbours and, with peer sampling,
+// peers of its passive view.
+func (gn *GossipNode) Views() (active, passive []int) {
+	return gn.processor.views()
+}
+
+// Pause freezes the node: its rounds stop and received messages are
+// buffered or dropped according to the config's PausePolicy.
+// The node's state doesn't change after Pause returns.
+func (gn *GossipNode) Pause() {
+	gn.work.Lock()
+	gn.paused = true
+	gn.work.Unlock()
+	gn.cfg.Logger.Printf("[NODE %d] paused", gn.id)
+}
+
+// Continue resumes the paused node with its queues intact.
+// Messages buffered during the pause are processed first,
+// by the node's goroutine on its next round or receipt.
+func (gn *GossipNode) Continue() {
+	gn.work.Lock()
+	gn.paused = false
+	n := len(gn.pending)
+	gn.work.Unlock()
+	gn.cfg.Logger.Printf("[NODE %d] continued with %d buffered messages", gn.id, n)
+}
+
+func (gn *GossipNode) send(addr string, msg Message) {
+	if gn.cfg.ProbeEvery > 0 {
+		msg = gn.processor.piggyback(msg)
+	}
+	if gn.simulated {
+		gn.transport.Send(addr, msg)
+		return
+	}
+	gn.sender.C <- senderPack{msg, addr} // sending task for node's sender
+}
+
 // GossipNet represents whole net. It consists of several nodes
-// and can be constructed of graph(TODO) or randomly.
+// and can be constructed of graph or randomly.
 type GossipNet struct {
-	size  int
-	nodes []*GossipNode
-	kill  chan struct{}
-	round time.Duration
+	size         int // IDs of nodes are less than size
+	nodes        []*GossipNode
+	running      bool
+	ctx          context.Context    // context of nodes' processing
+	cancel       context.CancelFunc // stops nodes' processing
+	cfg          Config
+	logfile      *os.File // session log opened by the net, if any
+	newTransport TransportFactory
+	clock        Clock
+	sim          *simulator // nil unless the net is in simulation mode
+	seed         int64
+	faults       *faultRules
 }
 
-func initLogger(logDirectoryPath string) *log.Logger {
-	var err error
+func initLogger(logDirectoryPath string) (*log.Logger, *os.File, error) {
 	filename := "session_" + time.Now().Format("20060102150405") + ".log"
-	logfile, _ = os.OpenFile(filepath.Join(logDirectoryPath, filename), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	logfile, err := os.OpenFile(filepath.Join(logDirectoryPath, filename), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 	if err != nil {
-		fmt.Println("Couldn't open file")
+		return nil, nil, err
 	}
-	return log.New(logfile, "TRACE:", log.Ltime)
+	return log.New(logfile, "TRACE:", log.Ltime), logfile, nil
 }
 
-func closeLogger() {
-	logger.Println("Closing log")
-	logfile.Close()
+// initSimLogger opens the session log of a simulation. Lines are stamped
+// with virtual time, so the log is the same for the same seed.
+func initSimLogger(logDirectoryPath string, sim *simulator, seed int64) (*log.Logger, *os.File, error) {
+	filename := "simulation_" + time.Now().Format("20060102150405") + "_" + strconv.FormatInt(seed, 10) + ".log"
+	logfile, err := os.OpenFile(filepath.Join(logDirectoryPath, filename), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, nil, err
+	}
+	return log.New(&clockWriter{logfile, sim}, "", 0), logfile, nil
 }
 
-// InitNet generates random net of size n. It uses graph package to create graph.
-func InitNet(n int, interval time.Duration) *GossipNet {
-	g := graph.Generate(n, 1, 5, BASE_PORT)
-	GNs := make([]*GossipNode, 0, n)
-	for i := 0; i < n; i++ {
-		node, _ := g.GetNode(i)
-		nodeId, _ := strconv.Atoi(node.String())
-		nodePort := node.Port()
-		neighs, _ := g.Neighbors(i)
-		gn := NewGossipNode(nodeId, nodePort, neighs)
-		GNs = append(GNs, gn)
+func (GN *GossipNet) closeLogger() error {
+	if GN.cfg.Logger == nil {
+		return nil
 	}
-	TTL = 10
-	return &GossipNet{
-		size:  n,
-		nodes: GNs,
-		kill:  make(chan struct{}, n),
-		round: interval,
+	GN.cfg.Logger.Println("Closing log")
+	if GN.logfile == nil {
+		return nil
 	}
+	err := GN.logfile.Close()
+	GN.logfile = nil
+	return err
 }
 
-// InitNetFromGraph generates net from input graph of package graph.
-// NOTE: It doesn't check the graph correctness.
-func InitNetFromGraph(g graph.Graph, interval time.Duration) *GossipNet {
+// newNet makes a net without nodes and applies options to it.
+// Zero Interval of the resulting config is replaced with interval.
+func newNet(interval time.Duration, opts []Option) *GossipNet {
+	GN := &GossipNet{
+		cfg:    DefaultConfig(),
+		clock:  realClock{},
+		faults: newFaultRules(),
+	}
+	GN.cfg.Interval = interval
+	for _, opt := range opts {
+		opt(GN)
+	}
+	if GN.cfg.Interval <= 0 {
+		GN.cfg.Interval = interval
+	}
+	if GN.sim != nil {
+		GN.clock = GN.sim
+		GN.newTransport = GN.sim.Listen
+	}
+	if GN.newTransport == nil {
+		codec := GN.cfg.Codec
+		if codec == nil {
+			codec = BinaryCodec
+		}
+		GN.newTransport = UDPTransportWith(codec)
+	}
+	open := GN.newTransport
+	GN.newTransport = func(addr string) (Transport, error) {
+		t, err := open(addr)
+		if err != nil {
+			return nil, err
+		}
+		seed := time.Now().UnixNano()
+		if GN.sim != nil {
+			seed = GN.sim.rng.Int63()
+		}
+		return newFaultTransport(t, addr, GN.faults, GN.clock, seed), nil
+	}
+	return GN
+}
+
+// addNodes makes nodes of the net from graph g.
+func (GN *GossipNet) addNodes(g graph.Graph) {
 	n := len(g)
 	GNs := make([]*GossipNode, 0, n)
 	for i := 0; i < n; i++ {
@@ -174,52 +482,358 @@ func InitNetFromGraph(g graph.Graph, interval time.Duration) *GossipNet {
 		nodeId, _ := strconv.Atoi(node.String())
 		nodePort := node.Port()
 		neighs, _ := g.Neighbors(i)
-		gn := NewGossipNode(nodeId, nodePort, neighs)
+		gn := newGossipNode(nodeId, nodePort, graphNeighbours(neighs, GN.cfg.Host), &GN.cfg)
+		gn.UseTransport(GN.newTransport)
+		gn.clock = GN.clock
+		if GN.sim != nil {
+			gn.processor.seed(GN.sim.rng.Int63())
+		}
 		GNs = append(GNs, gn)
+		if nodeId >= GN.size {
+			GN.size = nodeId + 1
+		}
 	}
-	TTL = 10
-	return &GossipNet{
-		size:  n,
-		nodes: GNs,
-		kill:  make(chan struct{}, n),
-		round: interval,
+	GN.nodes = GNs
+	ids := GN.ids()
+	for _, gn := range GNs {
+		gn.processor.setNodes(ids)
 	}
 }
 
-// SetTestMode sets the mode that stops processing
-// after first message is acked by all nodes.
-func (GN *GossipNet) SetTestMode() chan int {
-	testMode = true
-	feedback = make(chan int)
-	return feedback
+// InitNet generates random net of size n. It uses graph package to create graph.
+// Ports of nodes start from the config's BasePort.
+func InitNet(n int, interval time.Duration, opts ...Option) *GossipNet {
+	GN := newNet(interval, opts)
+	GN.addNodes(graph.Generate(n, 1, 5, GN.cfg.BasePort))
+	return GN
+}
+
+// InitNetFromGraph generates net from input graph of package graph.
+// NOTE: It doesn't check the graph correctness.
+func InitNetFromGraph(g graph.Graph, interval time.Duration, opts ...Option) *GossipNet {
+	GN := newNet(interval, opts)
+	GN.addNodes(g)
+	return GN
+}
+
+// SetFaults sets faults of every link of the net.
+// It can be called while the net is running.
+func (GN *GossipNet) SetFaults(f Faults) {
+	GN.faults.m.Lock()
+	GN.faults.global = f
+	GN.faults.m.Unlock()
+}
+
+// SetLinkFaults sets faults of the link from node with id from to node with id to.
+// They override faults set with SetFaults.
+func (GN *GossipNet) SetLinkFaults(from, to int, f Faults) error {
+	var l link
+	for _, gn := range GN.nodes {
+		if gn.id == from {
+			l.from = nodeAddr(GN.cfg.Host, gn.port)
+		}
+		if gn.id == to {
+			l.to = nodeAddr(GN.cfg.Host, gn.port)
+		}
+	}
+	if l.from == "" || l.to == "" {
+		return &errorString{"no such node in the net"}
+	}
+	GN.faults.m.Lock()
+	GN.faults.links[l] = f
+	GN.faults.m.Unlock()
+	return nil
 }
 
 // SetTTL sets TTL of every message upon the parameter
 func (GN *GossipNet) SetTTL(ttl int) {
-	TTL = ttl
+	GN.cfg.TTL = ttl
 }
 
-// Start lanches the gossip simulation. Also it inits the session logger.
-// Each node is launched in the sepotare goroutine.
-func (GN *GossipNet) Start(logDir string) {
-	logger = initLogger(logDir)
-	logger.Println(time.Now().String(), " Start")
-	for i := 0; i < GN.size; i++ {
-		go GN.nodes[i].Process(GN.kill, GN.round)
+// Start lanches the gossip simulation. Also it inits the session logger
+// unless the config has one. All nodes are bound first and if any of them
+// fails, the error is returned and nothing is launched. Then each node
+// is launched in the sepotare goroutine.
+//
+// In simulation mode nodes are only prepared to run, see Advance and RunUntil.
+func (GN *GossipNet) Start(logDir string) error {
+	if GN.cfg.Logger == nil {
+		var err error
+		if GN.sim != nil {
+			GN.cfg.Logger, GN.logfile, err = initSimLogger(logDir, GN.sim, GN.seed)
+		} else {
+			GN.cfg.Logger, GN.logfile, err = initLogger(logDir)
+		}
+		if err != nil {
+			return err
+		}
 	}
+	GN.cfg.Logger.Println(GN.clock.Now().String(), " Start")
+	if GN.sim != nil {
+		for i, gn := range GN.nodes {
+			if err := gn.simulate(GN.sim, GN.cfg.Interval); err != nil {
+				return GN.unbindAll(i, err)
+			}
+		}
+		GN.running = true
+		return nil
+	}
+	for i, gn := range GN.nodes {
+		if err := gn.Bind(); err != nil {
+			return GN.unbindAll(i, err)
+		}
+	}
+	GN.ctx, GN.cancel = context.WithCancel(context.Background())
+	for _, gn := range GN.nodes {
+		GN.launch(gn)
+	}
+	GN.running = true
 	time.Sleep(time.Second)
+	return nil
+}
+
+// launch starts processing of the bound node in a separate goroutine.
+func (GN *GossipNet) launch(gn *GossipNode) {
+	var ctx context.Context
+	ctx, gn.cancel = context.WithCancel(GN.ctx)
+	gn.stopped = make(chan struct{})
+	go func() {
+		defer close(gn.stopped)
+		gn.err = gn.Process(ctx, GN.cfg.Interval)
+	}()
+}
+
+// halt stops the running node and waits for it until ctx is done.
+// It returns the error of the node's processing.
+func (GN *GossipNet) halt(ctx context.Context, gn *GossipNode) error {
+	if GN.sim != nil {
+		if gn.stopSim != nil {
+			gn.stopSim()
+		}
+		return gn.Unbind()
+	}
+	gn.cancel()
+	select {
+	case <-gn.stopped:
+		return gn.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// unbindAll unbinds first n nodes after binding of node n failed with err
+// and closes the session logger. It returns all the errors.
+func (GN *GossipNet) unbindAll(n int, err error) error {
+	errs := []error{err}
+	for _, gn := range GN.nodes[:n] {
+		errs = append(errs, gn.Unbind())
+	}
+	errs = append(errs, GN.closeLogger())
+	return joinErrors(errs)
+}
+
+// CacheStats returns metrics of caches of already received messages
+// summed over all nodes. FalsePositiveRate is the max of nodes' ones.
+func (GN *GossipNet) CacheStats() CacheStats {
+	var s CacheStats
+	for _, gn := range GN.nodes {
+		s.add(gn.CacheStats())
+	}
+	return s
+}
+
+// TransportStats returns counters of transports summed over all nodes.
+func (GN *GossipNet) TransportStats() TransportStats {
+	var s TransportStats
+	for _, gn := range GN.nodes {
+		s.add(gn.TransportStats())
+	}
+	return s
+}
+
+// Pause freezes all nodes of the net, see GossipNode.Pause.
+func (GN *GossipNet) Pause() {
+	for _, gn := range GN.nodes {
+		gn.Pause()
+	}
+}
+
+// Continue resumes all nodes of the net after Pause.
+func (GN *GossipNet) Continue() {
+	for _, gn := range GN.nodes {
+		gn.Continue()
+	}
+}
+
+// Stop stops all nodes, waits for their goroutines to exit, closes
+// their transports and the session logger. It returns the errors
+// of closing or ctx.Err() if nodes didn't stop before ctx is done;
+// the logger stays open in that case.
+func (GN *GossipNet) Stop(ctx context.Context) error {
+	var errs []error
+	if GN.running {
+		if GN.cancel != nil {
+			GN.cancel()
+		}
+		for _, gn := range GN.nodes {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			errs = append(errs, GN.halt(ctx, gn))
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		GN.running = false
+		GN.ctx, GN.cancel = nil, nil
+	}
+	errs = append(errs, GN.closeLogger())
+	return joinErrors(errs)
+}
+
+// AddNode adds a new node connected to nodes with IDs neighbours to the net.
+// The node gets the next free ID and port. If the net is running, the node
+// is bound and started, otherwise it's started with the net. Messages made
+// before the node joined are not waited to be acked by it. With peer sampling
+// (see WithPeerSampling) neighbours are contacts: the node joins the net
+// through a random one of them and gets its neighbours by itself.
+func (GN *GossipNet) AddNode(neighbours []int) (int, error) {
+	neighs := make(map[int]string, len(neighbours))
+	port := GN.cfg.BasePort
+	for _, gn := range GN.nodes {
+		if gn.port >= port {
+			port = gn.port + 1
+		}
+	}
+	for _, id := range neighbours {
+		gn := GN.Node(id)
+		if gn == nil {
+			return 0, &errorString{"no such node in the net"}
+		}
+		neighs[id] = nodeAddr(GN.cfg.Host, gn.port)
+	}
+	sampling := GN.cfg.ShuffleEvery > 0
+	var gn *GossipNode
+	if sampling {
+		gn = newGossipNode(GN.size, port, map[int]string{}, &GN.cfg)
+	} else {
+		gn = newGossipNode(GN.size, port, neighs, &GN.cfg)
+	}
+	gn.UseTransport(GN.newTransport)
+	gn.clock = GN.clock
+	if GN.sim != nil {
+		gn.processor.seed(GN.sim.rng.Int63())
+	}
+	if GN.running {
+		var err error
+		if GN.sim != nil {
+			err = gn.simulate(GN.sim, GN.cfg.Interval)
+		} else {
+			err = gn.Bind()
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	for _, other := range GN.nodes {
+		other.processor.addNode(gn.id)
+	}
+	if sampling {
+		gn.processor.join(neighs)
+	} else {
+		for _, id := range neighbours {
+			GN.Node(id).processor.addNeighbour(gn.id, nodeAddr(GN.cfg.Host, gn.port))
+		}
+	}
+	GN.size++
+	GN.nodes = append(GN.nodes, gn)
+	gn.processor.setNodes(GN.ids())
+	if GN.running && GN.sim == nil {
+		GN.launch(gn)
+	}
+	if GN.cfg.Logger != nil {
+		GN.cfg.Logger.Printf("[NODE %d] joined the net with neighbours %v", gn.id, neighbours)
+	}
+	return gn.id, nil
+}
+
+// RemoveNode removes the node with id from the net and stops it.
+// A graceful leave disconnects the node from its neighbours at once,
+// otherwise the node crashes and its neighbours keep sending to it until
+// the failure detector (see WithMembership) declares it dead. In both cases
+// nodes stop waiting for its acks. It returns the error of stopping the node.
+func (GN *GossipNet) RemoveNode(id int, graceful bool) error {
+	gn := GN.Node(id)
+	if gn == nil {
+		return &errorString{"no such node in the net"}
+	}
+	var err error
+	if GN.running {
+		err = GN.halt(context.Background(), gn)
+	}
+	for i, other := range GN.nodes {
+		if other == gn {
+			GN.nodes = append(GN.nodes[:i], GN.nodes[i+1:]...)
+			break
+		}
+	}
+	for _, other := range GN.nodes {
+		if graceful {
+			other.processor.removeNeighbour(id)
+		}
+		other.processor.forgetNode(id, other.round())
+	}
+	if GN.cfg.Logger != nil {
+		GN.cfg.Logger.Printf("[NODE %d] left the net (graceful: %t)", id, graceful)
+	}
+	return err
+}
+
+// Node returns the node with id or nil if there is no such node.
+func (GN *GossipNet) Node(id int) *GossipNode {
+	for _, gn := range GN.nodes {
+		if gn.id == id {
+			return gn
+		}
+	}
+	return nil
 }
 
-// TODO: Pause(), Continue(), correct Stop()
+// ids returns IDs of nodes of the net.
+func (GN *GossipNet) ids() []int {
+	res := make([]int, 0, len(GN.nodes))
+	for _, gn := range GN.nodes {
+		res = append(res, gn.id)
+	}
+	return res
+}
 
-// Stop sends stop signals to nodes and closes the session logger.
-// NOTE: It doesn't truncate nodes' resources.
-func (GN *GossipNet) Stop() {
-	for i := 0; i <= GN.size; i++ {
-		GN.kill <- struct{}{}
-		time.Sleep(50 * time.Millisecond)
+// Advance runs the simulated net for d of virtual time.
+// It does nothing unless the net is in simulation mode.
+func (GN *GossipNet) Advance(d time.Duration) {
+	if GN.sim == nil {
+		return
+	}
+	deadline := GN.sim.now + d
+	for GN.sim.step(deadline) {
+	}
+	GN.sim.now = deadline
+}
+
+// RunUntil runs the simulated net until done returns true or limit
+// of virtual time passes. It reports whether done returned true.
+// done is checked after every event of the simulation.
+func (GN *GossipNet) RunUntil(done func() bool, limit time.Duration) bool {
+	if GN.sim == nil {
+		return false
+	}
+	deadline := GN.sim.now + limit
+	for !done() {
+		if !GN.sim.step(deadline) {
+			return false
+		}
 	}
-	closeLogger()
+	return true
 }
 
 type errorString struct {
@@ -230,11 +844,67 @@ func (e *errorString) Error() string {
 	return e.s
 }
 
+// NodeError is an error of a node's I/O.
+type NodeError struct {
+	Node int    // id of the node
+	Op   string // "bind", "receive", "send" or "close"
+	Err  error
+}
+
+func (e *NodeError) Error() string {
+	return fmt.Sprintf("node %d: %s: %v", e.Node, e.Op, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *NodeError) Unwrap() error {
+	return e.Err
+}
+
+// multiError is a list of errors of several nodes.
+type multiError []error
+
+func (e multiError) Error() string {
+	s := make([]string, 0, len(e))
+	for _, err := range e {
+		s = append(s, err.Error())
+	}
+	return strings.Join(s, "; ")
+}
+
+// Unwrap returns the errors of the list for errors.Is and errors.As.
+func (e multiError) Unwrap() []error {
+	return e
+}
+
+// joinErrors returns non-nil errors of errs as one error or nil if there are none.
+func joinErrors(errs []error) error {
+	var res multiError
+	for _, err := range errs {
+		if m, ok := err.(multiError); ok {
+			res = append(res, m...)
+		} else if err != nil {
+			res = append(res, err)
+		}
+	}
+	switch len(res) {
+	case 0:
+		return nil
+	case 1:
+		return res[0]
+	}
+	return res
+}
+
 // MakeRumour inits node with id id to generate new message and start tracking it.
-func (GN *GossipNet) MakeRumour(id int, msg Message) error {
-	exists := GN.nodes[id].putNewRumour(msg, GN.size)
-	if exists {
-		return &errorString{"such message ID has been sent already"}
+// ID, sender and origin of msg are set by the node. The returned handle
+// tells when and how fast the message is acked by all nodes.
+func (GN *GossipNet) MakeRumour(id int, msg Message) (*Rumour, error) {
+	gn := GN.Node(id)
+	if gn == nil {
+		return nil, &errorString{"no such node in the net"}
 	}
-	return nil
+	if len(msg.Data) > GN.cfg.maxMessageSize() {
+		return nil, &errorString{"message is too large"}
+	}
+	return gn.putNewRumour(msg), nil
 }
@@ -0,0 +1,176 @@
+package gossip
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestStopLeaksNoGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+	GN := InitNet(5, 10*time.Millisecond, WithMemTransport(), withQuietLog())
+	if err := GN.Start(""); err != nil {
+		t.Fatal(err)
+	}
+	r, err := GN.MakeRumour(0, Message{MsgType: "multicast", Data: "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := r.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := GN.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// goroutines exit right after they signal they've stopped
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		buf := make([]byte, 1<<16)
+		t.Fatalf("%d goroutines after Stop, %d before:\n%s", n, before, buf[:runtime.Stack(buf, true)])
+	}
+}
+
+func TestStopExpiredContext(t *testing.T) {
+	GN := InitNet(3, 10*time.Millisecond, WithMemTransport(), withQuietLog())
+	if err := GN.Start(""); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := GN.Stop(ctx); err != ctx.Err() {
+		t.Fatalf("Stop with expired context returned %v, want %v", err, ctx.Err())
+	}
+	if err := GN.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSubscriberPauses(t *testing.T) {
+	GN := InitNet(3, 10*time.Millisecond, WithSimulation(7), withQuietLog())
+	if err := GN.Start(""); err != nil {
+		t.Fatal(err)
+	}
+	got := map[int]int{}
+	for _, gn := range GN.nodes {
+		gn := gn
+		gn.Subscribe(func(msg Message) {
+			got[gn.id]++
+			gn.Pause()
+		})
+	}
+	r, err := GN.MakeRumour(0, Message{MsgType: "multicast", Data: "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got[0] != 0 {
+		t.Fatal("message is delivered by the goroutine which made it")
+	}
+	for i := 0; i < 100 && len(got) < 3; i++ {
+		GN.Advance(100 * time.Millisecond)
+		GN.Continue() // paused nodes don't forward the message
+	}
+	if len(got) < 3 {
+		t.Fatalf("message is delivered to %v, want all nodes", got)
+	}
+	if err := r.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for id, n := range got {
+		if n != 1 {
+			t.Fatalf("node %d got the message %d times", id, n)
+		}
+	}
+	GN.Stop(context.Background())
+}
+
+func TestAckHookCallsNode(t *testing.T) {
+	var GN *GossipNet
+	acked := 0
+	GN = InitNet(4, 10*time.Millisecond, WithSimulation(3), withQuietLog(), WithAckHook(func(node int, id MsgID, rounds int) {
+		gn := GN.Node(node)
+		gn.Members()
+		gn.Views()
+		gn.Set("acked", id.String())
+		acked++
+	}))
+	if err := GN.Start(""); err != nil {
+		t.Fatal(err)
+	}
+	defer GN.Stop(context.Background())
+	r, err := GN.MakeRumour(0, Message{MsgType: "multicast", Data: "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if acked != 1 {
+		t.Fatalf("hook is called %d times, want 1", acked)
+	}
+	if v, _ := GN.Node(0).Get(0, "acked"); v != r.ID().String() {
+		t.Fatalf("hook set %q, want %q", v, r.ID())
+	}
+}
+
+func TestJoinsAndLeavesOfRunningNet(t *testing.T) {
+	GN := InitNet(6, 100*time.Millisecond, WithSimulation(11), withQuietLog())
+	if err := GN.Start(""); err != nil {
+		t.Fatal(err)
+	}
+	defer GN.Stop(context.Background())
+	wait := func(r *Rumour) {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := r.Wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before, err := GN.MakeRumour(0, Message{MsgType: "multicast", Data: "before join"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// new nodes are leaves, so leaving doesn't split the net
+	crashed, err := GN.AddNode([]int{0, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	left, err := GN.AddNode([]int{2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int{crashed, left} {
+		if _, ok := before.Progress()[id]; ok {
+			t.Fatalf("message made before node %d joined waits for it", id)
+		}
+	}
+	wait(before)
+
+	after, err := GN.MakeRumour(0, Message{MsgType: "multicast", Data: "after join"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int{crashed, left} {
+		if acked, ok := after.Progress()[id]; !ok || acked {
+			t.Fatalf("node %d is not waited for (%t) or acked the message before it was sent (%t)", id, !ok, acked)
+		}
+	}
+	if err := GN.RemoveNode(crashed, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := GN.RemoveNode(left, true); err != nil {
+		t.Fatal(err)
+	}
+	wait(after)
+	for _, id := range []int{crashed, left} {
+		if _, ok := after.Progress()[id]; ok {
+			t.Fatalf("completed message waited for node %d which left", id)
+		}
+	}
+}
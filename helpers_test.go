@@ -0,0 +1,36 @@
+package gossip
+
+import (
+	"io"
+	"log"
+)
+
+// quietLogger discards logs of tests.
+var quietLogger = log.New(io.Discard, "", 0)
+
+// withQuietLog makes a net of a test log nothing.
+func withQuietLog() Option {
+	return WithLogger(quietLogger)
+}
+
+// testConfig returns the default config with the quiet logger.
+func testConfig() *Config {
+	cfg := DefaultConfig()
+	cfg.Logger = quietLogger
+	return &cfg
+}
+
+// testAddr returns the address of the node with id in tests.
+func testAddr(id int) string {
+	return nodeAddr("localhost", BASE_PORT+id)
+}
+
+// testProcessor makes a processor of the node with id connected to neighbours.
+// Its config is testConfig, tests may change it through p.cfg.
+func testProcessor(id int, neighbours ...int) *nodeProcessor {
+	addrs := make(map[int]string, len(neighbours))
+	for _, nid := range neighbours {
+		addrs[nid] = testAddr(nid)
+	}
+	return newNodeProcessor(id, addrs, testConfig())
+}
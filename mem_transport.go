@@ -0,0 +1,75 @@
+package gossip
+
+import "sync"
+
+// MemNetwork is an in-process medium for nodes which exchange
+// Message values over channels instead of sockets.
+type MemNetwork struct {
+	peers map[string]*memTransport // map[addr]transport
+	m     sync.RWMutex
+}
+
+// NewMemNetwork constructs an empty in-process network.
+func NewMemNetwork() *MemNetwork {
+	return &MemNetwork{peers: make(map[string]*memTransport)}
+}
+
+// Listen opens a transport with address addr in the network.
+// It can be used as a TransportFactory.
+func (mn *MemNetwork) Listen(addr string) (Transport, error) {
+	mn.m.Lock()
+	defer mn.m.Unlock()
+	if _, busy := mn.peers[addr]; busy {
+		return nil, &errorString{"address " + addr + " is already in use"}
+	}
+	t := &memTransport{
+		addr: addr,
+		net:  mn,
+		c:    make(chan Message, 100),
+	}
+	mn.peers[addr] = t
+	return t, nil
+}
+
+// memTransport counts sizes of messages as if they were encoded with BinaryCodec.
+type memTransport struct {
+	trafficCounter
+	addr string
+	net  *MemNetwork
+	c    chan Message
+}
+
+// Send puts msg in the recipient's channel. As with datagrams,
+// the message is lost if the recipient is absent or overloaded.
+func (t *memTransport) Send(addr string, msg Message) error {
+	t.net.m.RLock()
+	peer, ok := t.net.peers[addr]
+	t.net.m.RUnlock()
+	if !ok {
+		return nil
+	}
+	size := wireSize(BinaryCodec, msg)
+	t.sent(size)
+	select {
+	case peer.c <- msg:
+		peer.received(size)
+	default:
+	}
+	return nil
+}
+
+func (t *memTransport) Recv() <-chan Message {
+	return t.c
+}
+
+func (t *memTransport) Errors() <-chan error {
+	return nil
+}
+
+// Close removes the transport from the network.
+func (t *memTransport) Close() error {
+	t.net.m.Lock()
+	delete(t.net.peers, t.addr)
+	t.net.m.Unlock()
+	return nil
+}
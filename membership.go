@@ -0,0 +1,372 @@
+package gossip
+
+import (
+	"math"
+	"sort"
+)
+
+// MemberState is the state of a node in the view of another node.
+type MemberState int
+
+const (
+	MemberAlive   MemberState = iota // the node answers probes
+	MemberSuspect                    // the node didn't answer a probe and may be crashed
+	MemberDead                       // the node was suspected for too long, nobody sends to it but probes
+)
+
+func (s MemberState) String() string {
+	switch s {
+	case MemberAlive:
+		return "alive"
+	case MemberSuspect:
+		return "suspect"
+	case MemberDead:
+		return "dead"
+	}
+	return "unknown"
+}
+
+const (
+	defaultProbeTimeout   = 1
+	defaultIndirectProbes = 3
+	defaultSuspectTimeout = 5
+	// maxPiggyback is the max number of membership updates in one message.
+	maxPiggyback = 8
+)
+
+// MemberUpdate is the state of a node with its incarnation. Updates are piggybacked
+// on messages, an update with greater incarnation overrides older ones.
+type MemberUpdate struct {
+	Node        int         `json:"node"`
+	State       MemberState `json:"state"`
+	Incarnation uint64      `json:"inc"`
+}
+
+// MemberEvent reports that node Observer changed its view of another node.
+type MemberEvent struct {
+	Observer int
+	MemberUpdate
+}
+
+type member struct {
+	state MemberState
+	inc   uint64
+	since int  // round of the last change of state
+	local bool // the node suspects it itself, not by updates of others
+}
+
+// probe is the current probe of a node: ping is sent at round sent,
+// ping-reqs are sent if there is no ack in time.
+type probe struct {
+	id       MsgID
+	target   int
+	sent     int
+	indirect bool
+}
+
+// relay is a ping sent on behalf of requester by ping-req.
+type relay struct {
+	requester int
+	round     int
+}
+
+type pendingUpdate struct {
+	MemberUpdate
+	sent int // number of messages the update was piggybacked on
+}
+
+// membership is a SWIM-like failure detector of a node. Every ProbeEvery rounds
+// the node pings a neighbour, if there is no ack in ProbeTimeout rounds it asks
+// IndirectProbes other neighbours to ping it. A neighbour which didn't answer
+// is suspected and after SuspectTimeout rounds is declared dead. Changes of
+// states are piggybacked on messages, a suspected node refutes the suspicion
+// by increasing its incarnation.
+type membership struct {
+	inc     uint64 // incarnation of the node itself
+	members map[int]*member
+	order   []int // neighbours in probing order
+	next    int
+	seq     uint64
+	probe   *probe
+	relays  map[MsgID]relay
+	updates []*pendingUpdate
+}
+
+func newMembership(neighbours map[int]string) *membership {
+	ms := &membership{
+		members: make(map[int]*member),
+		relays:  make(map[MsgID]relay),
+	}
+	for id := range neighbours {
+		ms.members[id] = &member{state: MemberAlive}
+	}
+	return ms
+}
+
+func (p *nodeProcessor) probeTimeout() int {
+	if p.cfg.ProbeTimeout > 0 {
+		return p.cfg.ProbeTimeout
+	}
+	return defaultProbeTimeout
+}
+
+func (p *nodeProcessor) indirectProbes() int {
+	if p.cfg.IndirectProbes > 0 {
+		return p.cfg.IndirectProbes
+	}
+	return defaultIndirectProbes
+}
+
+func (p *nodeProcessor) suspectTimeout() int {
+	if p.cfg.SuspectTimeout > 0 {
+		return p.cfg.SuspectTimeout
+	}
+	return defaultSuspectTimeout
+}
+
+// reachable reports whether messages are sent to the node with id.
+func (p *nodeProcessor) reachable(id int) bool {
+	m, ok := p.members.members[id]
+	return !ok || m.state != MemberDead
+}
+
+// probeRound does the failure detector's work of the round.
+func (p *nodeProcessor) probeRound(round int) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	ms := p.members
+	period := p.cfg.ProbeEvery
+	if period <= p.probeTimeout() {
+		period = p.probeTimeout() + 1
+	}
+	if pr := ms.probe; pr != nil {
+		if round-pr.sent >= period {
+			p.cfg.Logger.Printf("[NODE %d] probe %s of node %d failed", p.myID, pr.id, pr.target)
+			ms.probe = nil
+			if m, ok := ms.members[pr.target]; ok && m.state != MemberDead {
+				if m.state == MemberAlive {
+					p.applyUpdate(MemberUpdate{pr.target, MemberSuspect, m.inc}, round)
+				}
+				m.local = true
+			}
+		} else if !pr.indirect && round-pr.sent >= p.probeTimeout() {
+			pr.indirect = true
+			helpers := []int{}
+			for _, id := range p.getNeighbours() {
+				if id != pr.target && ms.members[id].state == MemberAlive {
+					helpers = append(helpers, id)
+				}
+			}
+			p.rng.Shuffle(len(helpers), func(i, j int) { helpers[i], helpers[j] = helpers[j], helpers[i] })
+			if len(helpers) > p.indirectProbes() {
+				helpers = helpers[:p.indirectProbes()]
+			}
+			for _, id := range helpers {
+				p.sendTo(id, Message{ID: pr.id, MsgType: "ping-req", Sender: p.myID, Origin: p.myID, Target: pr.target})
+			}
+			// the ping or its ack may be lost, so it's sent again
+			p.sendTo(pr.target, Message{ID: pr.id, MsgType: "ping", Sender: p.myID, Origin: p.myID, Members: p.stateOf(pr.target)})
+		}
+	}
+	for _, id := range sortedKeys(ms.members) {
+		m := ms.members[id]
+		if m.state == MemberSuspect && m.local && round-m.since >= p.suspectTimeout() {
+			p.applyUpdate(MemberUpdate{id, MemberDead, m.inc}, round)
+		}
+	}
+	for id, r := range ms.relays {
+		if round-r.round >= period {
+			delete(ms.relays, id)
+		}
+	}
+	if ms.probe == nil && round%p.cfg.ProbeEvery == 0 {
+		target, ok := p.nextProbeTarget()
+		if !ok {
+			return
+		}
+		ms.seq++
+		ms.probe = &probe{id: MsgID{p.myID, ms.seq}, target: target, sent: round}
+		p.sendTo(target, Message{ID: ms.probe.id, MsgType: "ping", Sender: p.myID, Origin: p.myID, Members: p.stateOf(target)})
+	}
+}
+
+// nextProbeTarget picks neighbours in round-robin order which is shuffled on every pass.
+// Dead neighbours are probed too, so a node declared dead by mistake learns it
+// from the ack and refutes it.
+func (p *nodeProcessor) nextProbeTarget() (int, bool) {
+	ms := p.members
+	for _, id := range sortedPeers(p.neighbours) {
+		if m := ms.members[id]; m != nil && m.state == MemberSuspect {
+			return id, true
+		}
+	}
+	for tries := 0; tries < 2; tries++ {
+		for ; ms.next < len(ms.order); ms.next++ {
+			id := ms.order[ms.next]
+			if _, ok := p.neighbours[id]; ok {
+				ms.next++
+				return id, true
+			}
+		}
+		ms.order = sortedPeers(p.neighbours)
+		p.rng.Shuffle(len(ms.order), func(i, j int) { ms.order[i], ms.order[j] = ms.order[j], ms.order[i] })
+		ms.next = 0
+	}
+	return 0, false
+}
+
+// stateOf returns the state of the node with id to attach to a message
+// sent to it if the node is suspected or dead, so it can refute it.
+func (p *nodeProcessor) stateOf(id int) []MemberUpdate {
+	if m, ok := p.members.members[id]; ok && m.state != MemberAlive {
+		return []MemberUpdate{{id, m.state, m.inc}}
+	}
+	return nil
+}
+
+// processProbe handles ping, ping-req and ping-ack messages.
+func (p *nodeProcessor) processProbe(msg Message, round int) {
+	ms := p.members
+	switch msg.MsgType {
+	case "ping":
+		p.sendTo(msg.Sender, Message{ID: msg.ID, MsgType: "ping-ack", Sender: p.myID, Origin: p.myID, Members: p.stateOf(msg.Sender)})
+	case "ping-req":
+		if _, ok := p.neighbours[msg.Target]; !ok {
+			return // only common neighbours can help
+		}
+		ms.relays[msg.ID] = relay{msg.Sender, round}
+		p.sendTo(msg.Target, Message{ID: msg.ID, MsgType: "ping", Sender: p.myID, Origin: msg.Origin})
+	case "ping-ack":
+		if r, ok := ms.relays[msg.ID]; ok {
+			delete(ms.relays, msg.ID)
+			p.sendTo(r.requester, Message{ID: msg.ID, MsgType: "ping-ack", Sender: p.myID, Origin: msg.Origin})
+			return
+		}
+		if ms.probe != nil && ms.probe.id == msg.ID {
+			ms.probe = nil
+		}
+	}
+}
+
+// applyUpdates applies membership updates piggybacked on a message.
+func (p *nodeProcessor) applyUpdates(updates []MemberUpdate, round int) {
+	for _, u := range updates {
+		p.applyUpdate(u, round)
+	}
+}
+
+// applyUpdate changes the view of the node if u is newer than the known state:
+// it has greater incarnation, or the same one and a worse state. So like
+// a suspicion the death of a node is refuted by its newer incarnation.
+// Applied updates are disseminated further.
+func (p *nodeProcessor) applyUpdate(u MemberUpdate, round int) {
+	ms := p.members
+	if u.Node == p.myID {
+		if u.State == MemberAlive {
+			return
+		}
+		if u.Incarnation >= ms.inc {
+			ms.inc = u.Incarnation + 1
+			p.cfg.Logger.Printf("[NODE %d] refuting %s state with incarnation %d", p.myID, u.State, ms.inc)
+		}
+		// an old state is still gossiped, so the refutation is gossiped again
+		p.queueUpdate(MemberUpdate{p.myID, MemberAlive, ms.inc})
+		return
+	}
+	m, ok := ms.members[u.Node]
+	if ok {
+		switch u.State {
+		case MemberAlive:
+			ok = u.Incarnation > m.inc
+		case MemberSuspect:
+			ok = u.Incarnation > m.inc || (u.Incarnation == m.inc && m.state == MemberAlive)
+		case MemberDead:
+			ok = u.Incarnation > m.inc || (u.Incarnation == m.inc && m.state != MemberDead)
+		}
+		if !ok {
+			return
+		}
+	} else {
+		m = &member{}
+		ms.members[u.Node] = m
+	}
+	changed := m.state != u.State
+	m.state, m.inc, m.since, m.local = u.State, u.Incarnation, round, false
+	p.queueUpdate(u)
+	if u.State == MemberDead {
+		p.msgQueue.dropRecipient(u.Node)
+		p.ackQueue.dropRecipient(u.Node)
+		if p.cfg.ShuffleEvery > 0 {
+			p.neighbourFailed(u.Node)
+		}
+		defer p.checkAllAcked(round) // dead nodes are not waited for
+	}
+	if !changed {
+		return
+	}
+	p.cfg.Logger.Printf("[NODE %d] node %d is %s (incarnation %d)", p.myID, u.Node, u.State, u.Incarnation)
+	if p.cfg.OnMemberChange != nil {
+		p.events = append(p.events, MemberEvent{p.myID, u})
+	}
+}
+
+func (p *nodeProcessor) queueUpdate(u MemberUpdate) {
+	ms := p.members
+	for i, pu := range ms.updates {
+		if pu.Node == u.Node {
+			ms.updates = append(ms.updates[:i], ms.updates[i+1:]...)
+			break
+		}
+	}
+	ms.updates = append(ms.updates, &pendingUpdate{MemberUpdate: u})
+}
+
+// piggyback attaches the least sent membership updates to msg after
+// updates already put on it for the recipient.
+// Every update is sent about 3*log(n) times.
+func (p *nodeProcessor) piggyback(msg Message) Message {
+	p.m.Lock()
+	defer p.m.Unlock()
+	ms := p.members
+	if len(ms.updates) == 0 {
+		return msg
+	}
+	limit := 3 * int(math.Ceil(math.Log2(float64(len(ms.members)+2))))
+	sort.SliceStable(ms.updates, func(i, j int) bool { return ms.updates[i].sent < ms.updates[j].sent })
+	n := len(ms.updates)
+	if n > maxPiggyback {
+		n = maxPiggyback
+	}
+	for _, pu := range ms.updates[:n] {
+		msg.Members = append(msg.Members, pu.MemberUpdate)
+		pu.sent++
+	}
+	kept := ms.updates[:0]
+	for _, pu := range ms.updates {
+		if pu.sent < limit {
+			kept = append(kept, pu)
+		}
+	}
+	ms.updates = kept
+	return msg
+}
+
+// membersView returns states of nodes known to the node.
+func (p *nodeProcessor) membersView() map[int]MemberState {
+	p.m.Lock()
+	defer p.m.Unlock()
+	res := make(map[int]MemberState, len(p.members.members))
+	for id, m := range p.members.members {
+		res[id] = m.state
+	}
+	return res
+}
+
+func sortedKeys(m map[int]*member) []int {
+	res := make([]int, 0, len(m))
+	for key := range m {
+		res = append(res, key)
+	}
+	sort.Ints(res)
+	return res
+}
@@ -0,0 +1,114 @@
+package gossip
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestApplyUpdateOrder(t *testing.T) {
+	p := testProcessor(0, 1)
+	steps := []struct {
+		u    MemberUpdate
+		want MemberState
+		inc  uint64
+	}{
+		{MemberUpdate{1, MemberAlive, 2}, MemberAlive, 2},
+		{MemberUpdate{1, MemberDead, 1}, MemberAlive, 2}, // a stale death is ignored
+		{MemberUpdate{1, MemberSuspect, 2}, MemberSuspect, 2},
+		{MemberUpdate{1, MemberDead, 2}, MemberDead, 2},
+		{MemberUpdate{1, MemberAlive, 2}, MemberDead, 2},
+		{MemberUpdate{1, MemberAlive, 3}, MemberAlive, 3}, // the death is refuted
+		{MemberUpdate{1, MemberDead, 2}, MemberAlive, 3},
+	}
+	for i, s := range steps {
+		p.applyUpdate(s.u, i)
+		if m := p.members.members[1]; m.state != s.want || m.inc != s.inc {
+			t.Fatalf("step %d: %v gives %s %d, want %s %d", i, s.u, m.state, m.inc, s.want, s.inc)
+		}
+	}
+
+	p.applyUpdate(MemberUpdate{0, MemberDead, 0}, 0)
+	if p.members.inc != 1 {
+		t.Fatalf("incarnation %d after refuting, want 1", p.members.inc)
+	}
+	p.members.updates = nil
+	p.applyUpdate(MemberUpdate{0, MemberDead, 0}, 1)
+	if p.members.inc != 1 || len(p.members.updates) != 1 || p.members.updates[0].MemberUpdate != (MemberUpdate{0, MemberAlive, 1}) {
+		t.Fatalf("stale death of the node itself: incarnation %d, updates %v", p.members.inc, p.members.updates)
+	}
+}
+
+func TestCrashedNodeDeclaredDead(t *testing.T) {
+	var GN *GossipNet
+	var events []MemberEvent
+	GN = InitNet(6, 100*time.Millisecond, WithSimulation(5), withQuietLog(), WithMembership(1, 3, 5),
+		WithMemberHook(func(ev MemberEvent) {
+			GN.Node(ev.Observer).Members() // hooks may call the node
+			events = append(events, ev)
+		}))
+	if err := GN.Start(""); err != nil {
+		t.Fatal(err)
+	}
+	defer GN.Stop(context.Background())
+	GN.Advance(time.Second)
+	const crashed = 5
+	observers := sortedPeers(GN.Node(crashed).processor.neighbours)
+	if err := GN.RemoveNode(crashed, false); err != nil {
+		t.Fatal(err)
+	}
+	dead := func() bool {
+		for _, id := range observers {
+			if GN.Node(id).Members()[crashed] != MemberDead {
+				return false
+			}
+		}
+		return true
+	}
+	if !GN.RunUntil(dead, time.Minute) {
+		t.Fatal("crashed node is not declared dead by its neighbours")
+	}
+	suspected := false
+	for _, ev := range events {
+		suspected = suspected || ev.Node == crashed && ev.State == MemberSuspect
+	}
+	if !suspected {
+		t.Fatal("crashed node is declared dead without being suspected")
+	}
+	for _, id := range observers {
+		if containsInt(GN.Node(id).processor.getNeighbours(), crashed) {
+			t.Fatalf("node %d still sends to the dead node", id)
+		}
+	}
+	r, err := GN.MakeRumour(observers[0], Message{MsgType: "multicast", Data: "after crash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := r.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIndirectProbeRescuesLink(t *testing.T) {
+	GN := InitNet(3, 100*time.Millisecond, WithSimulation(5), withQuietLog(), WithMembership(1, 10, 3))
+	// x and y are neighbours of each other and of node 0, the link of 0 and x loses everything
+	x, _ := GN.AddNode([]int{0})
+	y, _ := GN.AddNode([]int{0, x})
+	if err := GN.Start(""); err != nil {
+		t.Fatal(err)
+	}
+	defer GN.Stop(context.Background())
+	GN.SetLinkFaults(0, x, Faults{Drop: 1})
+	GN.SetLinkFaults(x, 0, Faults{Drop: 1})
+	for i := 0; i < 100; i++ {
+		GN.Advance(100 * time.Millisecond)
+		if s := GN.Node(0).Members()[x]; s != MemberAlive {
+			t.Fatalf("node %d is %s for node 0 though node %d can reach it", x, s, y)
+		}
+		if s := GN.Node(x).Members()[0]; s != MemberAlive {
+			t.Fatalf("node 0 is %s for node %d though node %d can reach it", s, x, y)
+		}
+	}
+}
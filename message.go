@@ -2,21 +2,79 @@ package gossip
 
 import "fmt"
 
+// MsgID identifies a message in the whole net: it is made of
+// the id of the node that generated the message and the node's
+// sequence number of the message.
+type MsgID struct {
+	Node int    `json:"node"`
+	Seq  uint64 `json:"seq"`
+}
+
+func (id MsgID) String() string {
+	return fmt.Sprintf("%d.%d", id.Node, id.Seq)
+}
+
 // Message is the representation of a simple JSON message for nodes communications.
 type Message struct {
-	ID      int    `json:"id"`
-	MsgType string `json:"type"`
-	Sender  int    `json:"sender"`
-	Origin  int    `json:"origin"`
-	Data    string `json:"data"`
+	ID       MsgID          `json:"id"`
+	MsgType  string         `json:"type"`
+	Sender   int            `json:"sender"`
+	Origin   int            `json:"origin"`
+	Data     string         `json:"data"`
+	Digest   []MsgID        `json:"digest,omitempty"`   // IDs of known or requested messages for anti-entropy
+	Target   int            `json:"target,omitempty"`   // node to probe on behalf of the sender of ping-req
+	Members  []MemberUpdate `json:"members,omitempty"`  // piggybacked membership updates
+	Chunk    *Chunk         `json:"chunk,omitempty"`    // part of a large message the message carries
+	Batch    []Message      `json:"batch,omitempty"`    // messages packed into one datagram
+	Peers    []Peer         `json:"peers,omitempty"`    // peers exchanged by peer sampling
+	Hops     int            `json:"hops,omitempty"`     // remaining length of a random walk
+	Name     string         `json:"name,omitempty"`     // name of an aggregate or a CRDT replica
+	Values   []float64      `json:"values,omitempty"`   // share of an aggregate
+	Versions []StateVersion `json:"versions,omitempty"` // max versions of replicated state known by the sender
+	Entries  []StateEntry   `json:"entries,omitempty"`  // entries of replicated state
+	State    []byte         `json:"state,omitempty"`    // state of a CRDT replica
 }
 
 // NewMessage creates new message from input parameters.
-func NewMessage(id int, msgType string, sender int, origin int, data string) Message {
-	return Message{id, msgType, sender, origin, data}
+func NewMessage(id MsgID, msgType string, sender int, origin int, data string) Message {
+	return Message{ID: id, MsgType: msgType, Sender: sender, Origin: origin, Data: data}
 }
 
 func (m Message) String() string {
-	return fmt.Sprintf("{ ID: %d MsgType: %s Sender: %d Origin: %d Data: %s }",
+	res := fmt.Sprintf("{ ID: %s MsgType: %s Sender: %d Origin: %d Data: %s",
 		m.ID, m.MsgType, m.Sender, m.Origin, m.Data)
+	if len(m.Digest) > 0 {
+		res += fmt.Sprintf(" Digest: %v", m.Digest)
+	}
+	if m.MsgType == "ping-req" {
+		res += fmt.Sprintf(" Target: %d", m.Target)
+	}
+	if len(m.Members) > 0 {
+		res += fmt.Sprintf(" Members: %v", m.Members)
+	}
+	if len(m.Peers) > 0 {
+		res += fmt.Sprintf(" Peers: %v Hops: %d", m.Peers, m.Hops)
+	}
+	if m.Name != "" {
+		res += fmt.Sprintf(" Name: %s", m.Name)
+	}
+	if len(m.Versions) > 0 {
+		res += fmt.Sprintf(" Versions: %v", m.Versions)
+	}
+	if len(m.State) > 0 {
+		res += fmt.Sprintf(" State: %s", m.State)
+	}
+	if len(m.Entries) > 0 {
+		res += fmt.Sprintf(" Entries: %d", len(m.Entries))
+	}
+	if len(m.Values) > 0 {
+		res += fmt.Sprintf(" Values: %v", m.Values)
+	}
+	if len(m.Batch) > 0 {
+		res += fmt.Sprintf(" Batch: %d messages", len(m.Batch))
+	}
+	if m.Chunk != nil {
+		res += fmt.Sprintf(" Chunk: %d/%d of %s", m.Chunk.Index+1, m.Chunk.Count, m.Chunk.Of)
+	}
+	return res + " }"
 }
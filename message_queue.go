@@ -2,6 +2,7 @@ package gossip
 
 import (
 	"math/rand"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -10,18 +11,33 @@ type preparedMessage struct {
 	msg              Message
 	distributionList []int
 	ttl              int
+	next             int         // position in distributionList for round-robin
+	sent             map[int]int // map[recipient]number of times the message was sent to it
 }
 
 func newPreparedMessage(msg Message, list []int, ttl int) *preparedMessage {
-	return &preparedMessage{msg, list, ttl}
+	return &preparedMessage{msg: msg, distributionList: list, ttl: ttl}
+}
+
+func (m *preparedMessage) markSent(id int) {
+	if m.sent == nil {
+		m.sent = make(map[int]int)
+	}
+	m.sent[id]++
 }
 
 type messageQueue struct {
-	q []*preparedMessage
+	q         []*preparedMessage
+	rng       *rand.Rand
+	fanout    int
+	selection PeerSelection
 }
 
-func newMessageQueue() *messageQueue {
-	return &messageQueue{q: make([]*preparedMessage, 0, 100)}
+func newMessageQueue(rng *rand.Rand, fanout int, selection PeerSelection) *messageQueue {
+	if fanout <= 0 {
+		fanout = 1
+	}
+	return &messageQueue{q: make([]*preparedMessage, 0, 100), rng: rng, fanout: fanout, selection: selection}
 }
 
 func (q *messageQueue) String() string {
@@ -36,7 +52,7 @@ func (q *messageQueue) String() string {
 
 	res := ""
 	for _, val := range q.q {
-		res += strconv.Itoa(val.msg.ID) + " "
+		res += val.msg.ID.String() + " "
 		res += intSliceToString(val.distributionList)
 		res += "\n"
 	}
@@ -45,27 +61,140 @@ func (q *messageQueue) String() string {
 
 // putMessage emulates enqueue oreration.
 //
-// msg and its potential recipients are memorized.
-// Ttl is inited from package constant.
-func (q *messageQueue) putMessage(msg Message, recipients []int) {
-	q.q = append(q.q, newPreparedMessage(msg, recipients, TTL))
+// msg and its potential recipients are memorized, messages without recipients
+// or with ttl <= 0 are skipped. Ttl is inited from the net's config.
+func (q *messageQueue) putMessage(msg Message, recipients []int, ttl int) {
+	if len(recipients) == 0 || ttl <= 0 {
+		return
+	}
+	q.q = append(q.q, newPreparedMessage(msg, recipients, ttl))
 }
 
 // getMessage emulates dequeue operation.
 //
-// It gets random message and random recipient from slice.
-// NOTE: seed for random has to be inited in specific goroutine.
-func (q *messageQueue) getMessage() (msg Message, id int, empty bool) {
+// It gets a message and up to fanout recipients of it chosen by the queue's
+// selection strategy using the queue's source of randomness.
+// Ttl of the message is decreased once per recipient.
+func (q *messageQueue) getMessage() (msg Message, recipients []int, empty bool) {
 	if len(q.q) == 0 {
-		return Message{}, 0, true
+		return Message{}, nil, true
 	}
-	r := int(rand.Int31n(int32(len(q.q))))
+	r := q.pickMessage()
 	message := q.q[r]
-	t := int(rand.Int31n(int32(len((*message).distributionList))))
-	recipient := (*message).distributionList[t]
-	q.q[r].ttl--
-	if q.q[r].ttl == 0 {
+	k := q.fanout
+	if k > len(message.distributionList) {
+		k = len(message.distributionList)
+	}
+	if k > message.ttl {
+		k = message.ttl
+	}
+	recipients = q.pickRecipients(message, k)
+	for _, id := range recipients {
+		message.markSent(id)
+	}
+	message.ttl -= len(recipients)
+	if message.ttl <= 0 {
 		q.q = append(q.q[:r], q.q[r+1:]...)
 	}
-	return message.msg, recipient, false
+	return message.msg, recipients, false
+}
+
+// pickMessage returns the index of the message to send. With SelectByAge
+// messages are chosen with probability proportional to their remaining ttl,
+// so new messages are sent more often than old ones.
+func (q *messageQueue) pickMessage() int {
+	if q.selection != SelectByAge {
+		return int(q.rng.Int31n(int32(len(q.q))))
+	}
+	total := 0
+	for _, message := range q.q {
+		total += message.ttl
+	}
+	if total <= 0 {
+		return int(q.rng.Int31n(int32(len(q.q))))
+	}
+	x := q.rng.Intn(total)
+	for i, message := range q.q {
+		if x < message.ttl {
+			return i
+		}
+		x -= message.ttl
+	}
+	return len(q.q) - 1
+}
+
+// pickRecipients returns k different recipients of message.
+func (q *messageQueue) pickRecipients(message *preparedMessage, k int) []int {
+	list := message.distributionList
+	res := make([]int, 0, k)
+	switch q.selection {
+	case SelectRoundRobin:
+		for i := 0; i < k; i++ {
+			res = append(res, list[(message.next+i)%len(list)])
+		}
+		message.next = (message.next + k) % len(list)
+	case SelectUnsentFirst:
+		perm := q.rng.Perm(len(list))
+		sort.SliceStable(perm, func(i, j int) bool {
+			return message.sent[list[perm[i]]] < message.sent[list[perm[j]]]
+		})
+		for _, i := range perm[:k] {
+			res = append(res, list[i])
+		}
+	default:
+		if k == 1 {
+			return append(res, list[q.rng.Int31n(int32(len(list)))])
+		}
+		for _, i := range q.rng.Perm(len(list))[:k] {
+			res = append(res, list[i])
+		}
+	}
+	return res
+}
+
+// takeFor takes messages which can be sent to the node with id and which
+// fits accepts, in queue order. Their TTL is decreased as by getMessage.
+func (q *messageQueue) takeFor(id int, fits func(Message) bool) []Message {
+	var res []Message
+	kept := q.q[:0]
+	for _, message := range q.q {
+		if containsInt(message.distributionList, id) && fits(message.msg) {
+			res = append(res, message.msg)
+			message.markSent(id)
+			message.ttl--
+		}
+		if message.ttl > 0 {
+			kept = append(kept, message)
+		}
+	}
+	q.q = kept
+	return res
+}
+
+func containsInt(values []int, v int) bool {
+	for _, val := range values {
+		if val == v {
+			return true
+		}
+	}
+	return false
+}
+
+// dropRecipient removes the node with id from recipients of all messages.
+// Messages with no recipients left are removed.
+func (q *messageQueue) dropRecipient(id int) {
+	kept := q.q[:0]
+	for _, message := range q.q {
+		list := message.distributionList[:0]
+		for _, recipient := range message.distributionList {
+			if recipient != id {
+				list = append(list, recipient)
+			}
+		}
+		message.distributionList = list
+		if len(list) > 0 {
+			kept = append(kept, message)
+		}
+	}
+	q.q = kept
 }
@@ -0,0 +1,111 @@
+package gossip
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestMessageQueueSelection(t *testing.T) {
+	list := []int{1, 2, 3, 4, 5}
+	different := func(t *testing.T, sends [][]int) {
+		for _, recipients := range sends {
+			if len(recipients) != 2 || recipients[0] == recipients[1] {
+				t.Fatalf("recipients %v are not 2 different nodes", recipients)
+			}
+		}
+	}
+	tests := []struct {
+		name      string
+		selection PeerSelection
+		// check gets recipients of consecutive sends of one message
+		check func(t *testing.T, sends [][]int)
+	}{
+		{"random", SelectRandom, different},
+		{"round robin", SelectRoundRobin, func(t *testing.T, sends [][]int) {
+			var all []int
+			for _, recipients := range sends {
+				all = append(all, recipients...)
+			}
+			for i := range all {
+				if all[i] != list[i%len(list)] {
+					t.Fatalf("recipients %v are not in turn", all)
+				}
+			}
+		}},
+		{"unsent first", SelectUnsentFirst, func(t *testing.T, sends [][]int) {
+			sent := map[int]int{}
+			for _, recipients := range sends {
+				for _, id := range recipients {
+					sent[id]++
+				}
+				min, max := math.MaxInt32, 0
+				for _, id := range list {
+					if sent[id] < min {
+						min = sent[id]
+					}
+					if sent[id] > max {
+						max = sent[id]
+					}
+				}
+				if max-min > 1 {
+					t.Fatalf("node got the message %d times while another one got it %d times", max, min)
+				}
+			}
+		}},
+		{"by age", SelectByAge, different},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newMessageQueue(rand.New(rand.NewSource(1)), 2, tt.selection)
+			q.putMessage(NewMessage(MsgID{0, 1}, "multicast", 0, 0, "hello"), list, 12)
+			var sends [][]int
+			for {
+				_, recipients, empty := q.getMessage()
+				if empty {
+					break
+				}
+				sends = append(sends, recipients)
+			}
+			if len(sends) != 6 {
+				t.Fatalf("message with ttl 12 and fanout 2 is sent %d times, want 6", len(sends))
+			}
+			tt.check(t, sends)
+
+			q.putMessage(NewMessage(MsgID{0, 2}, "multicast", 0, 0, "hello"), list, 0)
+			if _, _, empty := q.getMessage(); !empty {
+				t.Fatal("message with ttl 0 is queued")
+			}
+		})
+	}
+}
+
+func TestSelectByAgeWeights(t *testing.T) {
+	q := newMessageQueue(rand.New(rand.NewSource(1)), 1, SelectByAge)
+	q.putMessage(NewMessage(MsgID{0, 1}, "multicast", 0, 0, "old"), []int{1}, 10)
+	q.putMessage(NewMessage(MsgID{0, 2}, "multicast", 0, 0, "new"), []int{1}, 90)
+	const n = 10000
+	picked := 0
+	for i := 0; i < n; i++ {
+		if q.pickMessage() == 1 {
+			picked++
+		}
+	}
+	if share := float64(picked) / n; math.Abs(share-0.9) > 0.02 {
+		t.Fatalf("message with 90%% of ttl is picked in %.3f of cases", share)
+	}
+}
+
+func TestZeroTTLByAge(t *testing.T) {
+	GN := InitNet(4, 100*time.Millisecond, WithSimulation(1), withQuietLog(), WithTTL(0), WithFanout(2, SelectByAge))
+	if err := GN.Start(""); err != nil {
+		t.Fatal(err)
+	}
+	defer GN.Stop(context.Background())
+	if _, err := GN.MakeRumour(0, Message{MsgType: "multicast", Data: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	GN.Advance(time.Second)
+}
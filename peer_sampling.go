@@ -0,0 +1,306 @@
+package gossip
+
+import "sort"
+
+const (
+	defaultActiveViewSize  = 5
+	defaultPassiveViewSize = 30
+	// activeWalk and passiveWalk are lengths of random walks of forward-join:
+	// the joining node is added to the passive view of the node passiveWalk
+	// hops away and to the active view of the last node of the walk.
+	activeWalk  = 6
+	passiveWalk = 3
+	// shuffleActive and shufflePassive are numbers of peers of the active
+	// and passive views sent in a shuffle.
+	shuffleActive  = 3
+	shufflePassive = 4
+	// neighbourTimeout is the number of rounds a node waits for the answer
+	// to a neighbour request before it tries another passive peer.
+	neighbourTimeout = 3
+)
+
+// Peer is a node with its address, known by a node which isn't its neighbour.
+type Peer struct {
+	ID   int    `json:"id"`
+	Addr string `json:"addr"`
+}
+
+// sampling is the HyParView peer sampling state of a node. The active view
+// is the node's neighbours which messages are gossiped to, the passive view
+// is a larger list of peers which replace failed neighbours. Passive views
+// are refreshed by periodic shuffles with random peers.
+type sampling struct {
+	passive map[int]string // map[peerID]peerAddr
+	pending int            // ID of the peer asked to become a neighbour
+	asked   int            // round of the request, -1 if there is no request
+}
+
+func newSampling() *sampling {
+	return &sampling{passive: make(map[int]string), asked: -1}
+}
+
+func (cfg *Config) activeViewSize() int {
+	if cfg.ActiveViewSize > 0 {
+		return cfg.ActiveViewSize
+	}
+	return defaultActiveViewSize
+}
+
+func (cfg *Config) passiveViewSize() int {
+	if cfg.PassiveViewSize > 0 {
+		return cfg.PassiveViewSize
+	}
+	return defaultPassiveViewSize
+}
+
+// self returns the node as a peer.
+func (p *nodeProcessor) self() Peer {
+	return Peer{p.myID, p.addr}
+}
+
+// join makes the node join the net through one of contacts.
+// Contacts become the node's passive view.
+func (p *nodeProcessor) join(contacts map[int]string) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	ids := make([]int, 0, len(contacts))
+	for id, addr := range contacts {
+		ids = append(ids, id)
+		p.addPassive(id, addr)
+	}
+	if len(ids) == 0 {
+		return
+	}
+	sort.Ints(ids)
+	contact := ids[p.rng.Intn(len(ids))]
+	p.cfg.Logger.Printf("[NODE %d] joining the net through node %d", p.myID, contact)
+	p.sendToAddr(contacts[contact], Message{MsgType: "join", Sender: p.myID, Origin: p.myID, Peers: []Peer{p.self()}})
+}
+
+// connect adds the peer to the active view. If the view is full,
+// a random neighbour is disconnected and moved to the passive view.
+func (p *nodeProcessor) connect(peer Peer) {
+	if peer.ID == p.myID {
+		return
+	}
+	if _, ok := p.neighbours[peer.ID]; ok {
+		return
+	}
+	if active := p.getNeighbours(); len(active) >= p.cfg.activeViewSize() {
+		drop := active[p.rng.Intn(len(active))]
+		addr := p.neighbours[drop]
+		p.sendToAddr(addr, Message{MsgType: "disconnect", Sender: p.myID, Origin: p.myID})
+		p.disconnect(drop)
+		p.addPassive(drop, addr)
+	}
+	delete(p.sampling.passive, peer.ID)
+	p.neighbours[peer.ID] = peer.Addr
+	p.members.members[peer.ID] = &member{state: MemberAlive}
+	p.tree.setEager(peer.ID)
+	p.cfg.Logger.Printf("[NODE %d] node %d is a neighbour now", p.myID, peer.ID)
+}
+
+// disconnect removes the neighbour from the active view. The node stops
+// probing it, unless it's dead the node forgets its state.
+func (p *nodeProcessor) disconnect(id int) {
+	if m, ok := p.members.members[id]; ok && m.state != MemberDead {
+		delete(p.members.members, id)
+	}
+	if pr := p.members.probe; pr != nil && pr.target == id {
+		p.members.probe = nil
+	}
+	delete(p.neighbours, id)
+	p.tree.remove(id)
+	p.msgQueue.dropRecipient(id)
+	p.ackQueue.dropRecipient(id)
+}
+
+// addPassive adds the peer to the passive view, a random peer
+// is dropped if the view is full.
+func (p *nodeProcessor) addPassive(id int, addr string) {
+	s := p.sampling
+	if id == p.myID || addr == "" {
+		return
+	}
+	if _, ok := p.neighbours[id]; ok {
+		return
+	}
+	if _, ok := s.passive[id]; ok {
+		return
+	}
+	if len(s.passive) >= p.cfg.passiveViewSize() {
+		ids := sortedPeers(s.passive)
+		delete(s.passive, ids[p.rng.Intn(len(ids))])
+	}
+	s.passive[id] = addr
+}
+
+// neighbourFailed replaces the neighbour which is found dead.
+func (p *nodeProcessor) neighbourFailed(id int) {
+	if _, ok := p.neighbours[id]; ok {
+		p.cfg.Logger.Printf("[NODE %d] neighbour %d failed", p.myID, id)
+		p.disconnect(id)
+	}
+	delete(p.sampling.passive, id)
+}
+
+// samplingRound does the peer sampling work of the round: asks a passive
+// peer to become a neighbour if the active view isn't full and shuffles
+// the passive view every ShuffleEvery rounds.
+func (p *nodeProcessor) samplingRound(round int) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	s := p.sampling
+	if s.asked >= 0 && round-s.asked >= neighbourTimeout {
+		delete(s.passive, s.pending) // it doesn't answer, so it's probably dead
+		s.asked = -1
+	}
+	active := p.getNeighbours()
+	if s.asked < 0 && len(active) < p.cfg.activeViewSize() {
+		candidates := []int{}
+		for _, id := range sortedPeers(s.passive) {
+			if p.reachable(id) {
+				candidates = append(candidates, id)
+			}
+		}
+		if len(candidates) > 0 {
+			s.pending = candidates[p.rng.Intn(len(candidates))]
+			s.asked = round
+			priority := "low"
+			if len(active) == 0 {
+				priority = "high"
+			}
+			p.sendToAddr(s.passive[s.pending], Message{MsgType: "neighbour", Sender: p.myID, Origin: p.myID, Data: priority, Peers: []Peer{p.self()}})
+		}
+	}
+	if round%p.cfg.ShuffleEvery == 0 && len(active) > 0 {
+		to := active[p.rng.Intn(len(active))]
+		peers := append([]Peer{p.self()}, p.samplePeers(active, shuffleActive, to)...)
+		peers = append(peers, p.samplePeers(sortedPeers(s.passive), shufflePassive, to)...)
+		p.sendTo(to, Message{MsgType: "shuffle", Sender: p.myID, Origin: p.myID, Hops: passiveWalk, Peers: peers})
+	}
+}
+
+// samplePeers returns at most n random peers of ids except the node with id except.
+func (p *nodeProcessor) samplePeers(ids []int, n int, except int) []Peer {
+	res := []Peer{}
+	for _, i := range p.rng.Perm(len(ids)) {
+		if len(res) == n {
+			break
+		}
+		id := ids[i]
+		if id == except {
+			continue
+		}
+		addr, ok := p.neighbours[id]
+		if !ok {
+			addr = p.sampling.passive[id]
+		}
+		res = append(res, Peer{id, addr})
+	}
+	return res
+}
+
+// processSampling handles messages of peer sampling.
+func (p *nodeProcessor) processSampling(msg Message) {
+	s := p.sampling
+	if len(msg.Peers) == 0 && msg.MsgType != "disconnect" && msg.MsgType != "neighbour-reject" {
+		return
+	}
+	switch msg.MsgType {
+	case "join":
+		joiner := msg.Peers[0]
+		p.connect(joiner)
+		p.sendTo(joiner.ID, Message{MsgType: "neighbour-accept", Sender: p.myID, Origin: p.myID, Peers: []Peer{p.self()}})
+		for _, id := range p.getNeighbours() {
+			if id != joiner.ID {
+				p.sendTo(id, Message{MsgType: "forward-join", Sender: p.myID, Origin: p.myID, Hops: activeWalk, Peers: msg.Peers[:1]})
+			}
+		}
+	case "forward-join":
+		joiner := msg.Peers[0]
+		active := p.getNeighbours()
+		if msg.Hops <= 1 || len(active) <= 1 {
+			if _, ok := p.neighbours[joiner.ID]; !ok && joiner.ID != p.myID {
+				p.connect(joiner)
+				p.sendToAddr(joiner.Addr, Message{MsgType: "neighbour-accept", Sender: p.myID, Origin: p.myID, Peers: []Peer{p.self()}})
+			}
+			return
+		}
+		if msg.Hops == passiveWalk {
+			p.addPassive(joiner.ID, joiner.Addr)
+		}
+		next := []int{}
+		for _, id := range active {
+			if id != msg.Sender && id != joiner.ID {
+				next = append(next, id)
+			}
+		}
+		if len(next) > 0 {
+			p.sendTo(next[p.rng.Intn(len(next))], Message{MsgType: "forward-join", Sender: p.myID, Origin: msg.Origin, Hops: msg.Hops - 1, Peers: msg.Peers[:1]})
+		}
+	case "neighbour":
+		if msg.Data == "high" || len(p.getNeighbours()) < p.cfg.activeViewSize() {
+			p.connect(msg.Peers[0])
+			p.sendTo(msg.Sender, Message{MsgType: "neighbour-accept", Sender: p.myID, Origin: p.myID, Peers: []Peer{p.self()}})
+		} else {
+			p.sendToAddr(msg.Peers[0].Addr, Message{MsgType: "neighbour-reject", Sender: p.myID, Origin: p.myID})
+		}
+	case "neighbour-accept":
+		if s.asked >= 0 && s.pending == msg.Sender {
+			s.asked = -1
+		}
+		p.connect(msg.Peers[0])
+	case "neighbour-reject":
+		if s.asked >= 0 && s.pending == msg.Sender {
+			s.asked = -1
+		}
+	case "disconnect":
+		if addr, ok := p.neighbours[msg.Sender]; ok {
+			p.cfg.Logger.Printf("[NODE %d] disconnected by node %d", p.myID, msg.Sender)
+			p.disconnect(msg.Sender)
+			p.addPassive(msg.Sender, addr)
+		}
+	case "shuffle":
+		next := []int{}
+		for _, id := range p.getNeighbours() {
+			if id != msg.Sender && id != msg.Origin {
+				next = append(next, id)
+			}
+		}
+		if msg.Hops > 1 && len(next) > 0 {
+			fwd := msg
+			fwd.Sender = p.myID
+			fwd.Hops--
+			fwd.Members = nil
+			p.sendTo(next[p.rng.Intn(len(next))], fwd)
+			return
+		}
+		origin := msg.Peers[0]
+		reply := p.samplePeers(sortedPeers(s.passive), len(msg.Peers), origin.ID)
+		p.sendToAddr(origin.Addr, Message{MsgType: "shuffle-reply", Sender: p.myID, Origin: p.myID, Peers: reply})
+		for _, peer := range msg.Peers {
+			p.addPassive(peer.ID, peer.Addr)
+		}
+	case "shuffle-reply":
+		for _, peer := range msg.Peers {
+			p.addPassive(peer.ID, peer.Addr)
+		}
+	}
+}
+
+// views returns IDs of the node's neighbours and of its passive peers.
+func (p *nodeProcessor) views() (active, passive []int) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.getNeighbours(), sortedPeers(p.sampling.passive)
+}
+
+func sortedPeers(m map[int]string) []int {
+	res := make([]int, 0, len(m))
+	for key := range m {
+		res = append(res, key)
+	}
+	sort.Ints(res)
+	return res
+}
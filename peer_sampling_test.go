@@ -0,0 +1,90 @@
+package gossip
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestPeerSamplingSurvivesChurn(t *testing.T) {
+	GN := InitNet(12, 100*time.Millisecond, WithSimulation(22), withQuietLog(),
+		WithMembership(1, 3, 3), WithPeerSampling(4, 12, 5))
+	got := subscribeAll(GN)
+	if err := GN.Start(""); err != nil {
+		t.Fatal(err)
+	}
+	defer GN.Stop(context.Background())
+	GN.Advance(5 * time.Second)
+
+	rng := rand.New(rand.NewSource(22))
+	removed := map[int]bool{}
+	joins, crashes := 5, 8
+	for joins+crashes > 0 {
+		ids := GN.ids()
+		if rng.Intn(joins+crashes) < joins {
+			id, err := GN.AddNode([]int{ids[rng.Intn(len(ids))]})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got[id] = map[MsgID]bool{}
+			GN.Node(id).Subscribe(func(msg Message) { got[id][msg.ID] = true })
+			joins--
+		} else {
+			id := ids[rng.Intn(len(ids))]
+			if err := GN.RemoveNode(id, false); err != nil {
+				t.Fatal(err)
+			}
+			removed[id] = true
+			delete(got, id)
+			crashes--
+		}
+		GN.Advance(2 * time.Second)
+	}
+	GN.Advance(20 * time.Second)
+
+	// active views of live nodes have no crashed nodes and connect them all
+	ids := GN.ids()
+	reached := map[int]bool{ids[0]: true}
+	queue := []int{ids[0]}
+	edges := map[int][]int{}
+	for _, id := range ids {
+		active, _ := GN.Node(id).Views()
+		for _, peer := range active {
+			if removed[peer] {
+				t.Fatalf("node %d keeps crashed node %d in its active view", id, peer)
+			}
+			edges[id] = append(edges[id], peer)
+			edges[peer] = append(edges[peer], id)
+		}
+	}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		for _, peer := range edges[id] {
+			if !reached[peer] {
+				reached[peer] = true
+				queue = append(queue, peer)
+			}
+		}
+	}
+	if len(reached) != len(ids) {
+		t.Fatalf("active views connect %d of %d live nodes", len(reached), len(ids))
+	}
+
+	r, err := GN.MakeRumour(ids[0], Message{MsgType: "multicast", Data: "after churn"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := func() bool {
+		for _, msgs := range got {
+			if !msgs[r.ID()] {
+				return false
+			}
+		}
+		return true
+	}
+	if !GN.RunUntil(all, 10*time.Second) {
+		t.Fatal("message is not delivered to all live nodes after churn")
+	}
+}
@@ -0,0 +1,186 @@
+package gossip
+
+import "sort"
+
+const (
+	// defaultGraftTimeout is the number of rounds a node waits for a message
+	// announced by a neighbour before it grafts the neighbour.
+	defaultGraftTimeout = 2
+	// maxGrafts is the number of grafts for a message after which
+	// the node stops waiting for it.
+	maxGrafts = 30
+	// announceRounds is the max number of rounds a message is announced
+	// to a neighbour in. Announcements stop once the neighbour's ack comes,
+	// so lost announcements and pushes don't lose the message.
+	announceRounds = 10
+)
+
+// plumtree is the state of Plumtree dissemination: multicast messages are
+// pushed eagerly along a spanning tree and lazily announced by IDs to
+// neighbours, which graft the announcing neighbour into the tree if the
+// message doesn't come through the tree in time.
+type plumtree struct {
+	eager    map[int]bool              // neighbours messages are pushed to, the others are lazy
+	announce map[int][]announcement    // map[neighbour]messages to announce
+	missing  map[MsgID]*missingMessage // announced messages which are not received yet
+}
+
+// announcement is an ID of a message announced in left more rounds.
+type announcement struct {
+	id   MsgID
+	left int
+}
+
+// missingMessage is a message announced by neighbours.
+type missingMessage struct {
+	since   int   // round of the last graft or the first announcement
+	sources []int // neighbours which announced it, asked in turn
+	grafts  int
+}
+
+func newPlumtree(neighbours map[int]string) *plumtree {
+	t := &plumtree{
+		eager:    make(map[int]bool),
+		announce: make(map[int][]announcement),
+		missing:  make(map[MsgID]*missingMessage),
+	}
+	for id := range neighbours {
+		t.eager[id] = true
+	}
+	return t
+}
+
+func (t *plumtree) setEager(id int) {
+	t.eager[id] = true
+}
+
+func (t *plumtree) setLazy(id int) {
+	delete(t.eager, id)
+}
+
+func (t *plumtree) remove(id int) {
+	delete(t.eager, id)
+	delete(t.announce, id)
+}
+
+func (p *nodeProcessor) graftTimeout() int {
+	if p.cfg.GraftTimeout > 0 {
+		return p.cfg.GraftTimeout
+	}
+	return defaultGraftTimeout
+}
+
+// treePush pushes msg to eager neighbours and announces it to all neighbours
+// except the neighbour it is received from. Eager neighbours get announcements
+// too, as pushes over lossy links can be lost. The sender joins the tree.
+func (p *nodeProcessor) treePush(msg Message, from int) {
+	t := p.tree
+	delete(t.missing, msg.ID)
+	if _, ok := p.neighbours[from]; ok {
+		t.setEager(from)
+	}
+	for _, id := range p.getNeighbours() {
+		if id == from {
+			continue
+		}
+		if t.eager[id] {
+			p.sendTo(id, msg)
+		}
+		t.announce[id] = append(t.announce[id], announcement{msg.ID, announceRounds})
+	}
+}
+
+// pruneSender leaves the neighbour a duplicate came from out of the tree.
+func (p *nodeProcessor) pruneSender(msg Message) {
+	if !p.tree.eager[msg.Sender] {
+		return
+	}
+	p.tree.setLazy(msg.Sender)
+	p.cfg.Logger.Printf("[NODE %d] pruned link to node %d", p.myID, msg.Sender)
+	p.sendTo(msg.Sender, Message{MsgType: "prune", Sender: p.myID, Origin: p.myID})
+}
+
+// processTree handles messages which maintain the tree.
+func (p *nodeProcessor) processTree(msg Message, curCount int) {
+	t := p.tree
+	if _, ok := p.neighbours[msg.Sender]; !ok {
+		return
+	}
+	switch msg.MsgType {
+	case "prune":
+		t.setLazy(msg.Sender)
+	case "ihave":
+		for _, id := range msg.Digest {
+			if p.msgIDs.has(seenKey{id, -1}, curCount) {
+				continue
+			}
+			m, ok := t.missing[id]
+			if !ok {
+				m = &missingMessage{since: curCount}
+				t.missing[id] = m
+			}
+			if !containsInt(m.sources, msg.Sender) {
+				m.sources = append(m.sources, msg.Sender)
+			}
+		}
+	case "graft":
+		t.setEager(msg.Sender)
+		p.cfg.Logger.Printf("[NODE %d] grafted by node %d", p.myID, msg.Sender)
+		for _, id := range msg.Digest {
+			p.pushStored(msg.Sender, id)
+		}
+	}
+}
+
+// treeRound sends announcements of messages neighbours didn't ack yet and grafts
+// neighbours which announced messages not received in time, one
+// neighbour per message per timeout in turn, as grafts can be lost too.
+func (p *nodeProcessor) treeRound(curCount int) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	t := p.tree
+	for _, id := range p.getNeighbours() {
+		var ids []MsgID
+		kept := t.announce[id][:0]
+		for _, a := range t.announce[id] {
+			if p.ackIDs.peek(seenKey{a.id, id}, curCount) {
+				continue // the neighbour has the message
+			}
+			ids = append(ids, a.id)
+			if a.left--; a.left > 0 {
+				kept = append(kept, a)
+			}
+		}
+		t.announce[id] = kept
+		if len(ids) > 0 {
+			p.sendTo(id, Message{MsgType: "ihave", Sender: p.myID, Origin: p.myID, Digest: ids})
+		}
+	}
+	ids := make([]MsgID, 0, len(t.missing))
+	for id := range t.missing {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i].Node < ids[j].Node || ids[i].Node == ids[j].Node && ids[i].Seq < ids[j].Seq
+	})
+	for _, id := range ids {
+		m := t.missing[id]
+		if curCount-m.since < p.graftTimeout() {
+			continue
+		}
+		for len(m.sources) > 0 && !p.reachable(m.sources[0]) {
+			m.sources = m.sources[1:]
+		}
+		if len(m.sources) == 0 || m.grafts >= maxGrafts {
+			delete(t.missing, id)
+			continue
+		}
+		to := m.sources[0]
+		m.sources = append(m.sources[1:], to)
+		m.since = curCount
+		m.grafts++
+		t.setEager(to)
+		p.cfg.Logger.Printf("[NODE %d] grafting node %d for message %s", p.myID, to, id)
+		p.sendTo(to, Message{MsgType: "graft", Sender: p.myID, Origin: p.myID, Digest: []MsgID{id}})
+	}
+}
@@ -0,0 +1,101 @@
+package gossip
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// pushCounter counts multicast messages sent through a transport.
+type pushCounter struct {
+	Transport
+	pushes *int
+}
+
+func (t *pushCounter) Send(addr string, msg Message) error {
+	if msg.MsgType == "multicast" {
+		*t.pushes++
+	}
+	return t.Transport.Send(addr, msg)
+}
+
+// countPushes makes nodes of the simulated net count their pushes in pushes.
+func countPushes(GN *GossipNet, pushes *int) {
+	for _, gn := range GN.nodes {
+		open := gn.newTransport
+		gn.UseTransport(func(addr string) (Transport, error) {
+			t, err := open(addr)
+			return &pushCounter{t, pushes}, err
+		})
+	}
+}
+
+// subscribeAll counts deliveries of every node of the net.
+func subscribeAll(GN *GossipNet) map[int]map[MsgID]bool {
+	got := map[int]map[MsgID]bool{}
+	for _, id := range GN.ids() {
+		id := id
+		got[id] = map[MsgID]bool{}
+		GN.Node(id).Subscribe(func(msg Message) { got[id][msg.ID] = true })
+	}
+	return got
+}
+
+func TestPlumtreeDeliversUnderLoss(t *testing.T) {
+	const n, messages = 10, 150
+	GN := InitNet(n, 100*time.Millisecond, WithSimulation(21), withQuietLog(), WithPlumtree(2))
+	got := subscribeAll(GN)
+	if err := GN.Start(""); err != nil {
+		t.Fatal(err)
+	}
+	defer GN.Stop(context.Background())
+	GN.SetFaults(Faults{Drop: 0.3})
+	for i := 0; i < messages; i++ {
+		if _, err := GN.MakeRumour(i%n, Message{MsgType: "multicast", Data: strconv.Itoa(i)}); err != nil {
+			t.Fatal(err)
+		}
+		GN.Advance(100 * time.Millisecond)
+	}
+	all := func() bool {
+		for _, msgs := range got {
+			if len(msgs) < messages {
+				return false
+			}
+		}
+		return true
+	}
+	if !GN.RunUntil(all, time.Minute) {
+		for id, msgs := range got {
+			t.Errorf("node %d got %d of %d messages", id, len(msgs), messages)
+		}
+	}
+}
+
+func TestPlumtreePrunesToTree(t *testing.T) {
+	const n = 10
+	pushes := 0
+	GN := InitNet(n, 100*time.Millisecond, WithSimulation(21), withQuietLog(), WithPlumtree(2))
+	countPushes(GN, &pushes)
+	if err := GN.Start(""); err != nil {
+		t.Fatal(err)
+	}
+	defer GN.Stop(context.Background())
+	var perMessage []int
+	for i := 0; i < 20; i++ {
+		before := pushes
+		if _, err := GN.MakeRumour(i%n, Message{MsgType: "multicast", Data: strconv.Itoa(i)}); err != nil {
+			t.Fatal(err)
+		}
+		GN.Advance(time.Second)
+		perMessage = append(perMessage, pushes-before)
+	}
+	if perMessage[0] <= n-1 {
+		t.Fatalf("first message is pushed %d times, want more than %d before the tree is pruned", perMessage[0], n-1)
+	}
+	for _, p := range perMessage[len(perMessage)-5:] {
+		if p != n-1 {
+			t.Fatalf("pushes per message are %v, want %d once the tree is pruned", perMessage, n-1)
+		}
+	}
+}
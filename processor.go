@@ -1,130 +1,179 @@
 package gossip
 
 import (
-	"net"
+	"math/rand"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"gitlab.com/n-canter/graph"
 )
 
 type nodeProcessor struct {
-	myID       int                  // unique id of processor in the Net
-	neighbours map[int]*net.UDPAddr // map[nodeID]nodeAddr
-	msgIDs     []int                // slice of already received message IDs
-	ackIDs     map[int][]int        // map[msgID]slice of node IDs sent ack with msgID
-	msgQueue   *messageQueue        // queue of messages to send
-	ackQueue   *messageQueue        // queue of acks to send
-	acks       map[int][]bool       // map[msgID](slice[nodeID]=true/false)
-	                                //     note: key is deleted after all ackes recieved
-	waiting    map[int]int          // map[msgID] counter value on message initialization
-	                                //      note: key is the flag of initializing message
-	m          sync.Mutex           // safe new message initialization
-}
-
-func newNodeProcessor(id int, neighs []graph.Node) *nodeProcessor {
-	getAddr := func(port int) *net.UDPAddr {
-		laddr, _ := net.ResolveUDPAddr("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
-		return laddr
-	}
-	makeNeighMap := func() map[int]*net.UDPAddr {
-		m := make(map[int]*net.UDPAddr)
-		for _, node := range neighs {
-			nid, _ := strconv.Atoi(node.String())
-			m[nid] = getAddr(node.Port())
-		}
-		return m
+	myID       int                    // unique id of processor in the Net
+	addr       string                 // address of the node
+	neighbours map[int]string         // map[nodeID]nodeAddr
+	msgIDs     *seenCache             // already received message IDs
+	ackIDs     *seenCache             // already received acks: message ID and ID of acking node
+	msgQueue   *messageQueue          // queue of messages to send
+	ackQueue   *messageQueue          // queue of acks to send
+	nodes      map[int]bool           // IDs of all nodes of the net the node knows
+	acks       map[MsgID]map[int]bool // map[msgID](map[nodeID]=true/false)
+	//     note: key is deleted after all ackes recieved
+	waiting map[MsgID]int // map[msgID] counter value on message initialization
+	//      note: key is the flag of initializing message
+	rumours    map[MsgID]*Rumour          // handles of messages made by the node
+	store      *messageStore              // recently received messages for anti-entropy
+	members    *membership                // failure detector and the view of live nodes
+	tree       *plumtree                  // dissemination tree in Plumtree mode
+	sampling   *sampling                  // passive view of peer sampling
+	state      *kvState                   // replicated key-value state of nodes
+	crdts      map[string]CRDT            // registry of replicas by name
+	states     map[stateKey]*partialState // states of replicas being reassembled
+	aggregates map[string]*aggregate      // states of aggregates by name
+	outbox     []outPack                  // messages to send right after processing
+	inbox      []Message                  // new messages to deliver to the application
+	acked      []ackedMessage             // completed messages to call the config's OnAcked with
+	events     []MemberEvent              // membership changes to call the config's OnMemberChange with
+	partial    map[MsgID]*partialMessage  // large messages being reassembled
+	rng        *rand.Rand                 // source of randomness for queues
+	cfg        *Config                    // config of the node's net
+	m          sync.Mutex                 // safe new message initialization
+}
+
+// graphNeighbours makes the map of neighbours' addresses from graph nodes.
+func graphNeighbours(neighs []graph.Node, host string) map[int]string {
+	m := make(map[int]string)
+	for _, node := range neighs {
+		nid, _ := strconv.Atoi(node.String())
+		m[nid] = nodeAddr(host, node.Port())
 	}
+	return m
+}
 
+func newNodeProcessor(id int, neighbours map[int]string, cfg *Config) *nodeProcessor {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano() + int64(id)))
+	nodes := map[int]bool{id: true}
+	for nid := range neighbours {
+		nodes[nid] = true
+	}
 	return &nodeProcessor{
 		myID:       id,
-		neighbours: makeNeighMap(),
-		msgIDs:     make([]int, 0, 10),
-		ackIDs:     make(map[int][]int),
-		msgQueue:   newMessageQueue(),
-		ackQueue:   newMessageQueue(),
-		acks:       make(map[int][]bool),
-		waiting:    make(map[int]int),
-	}
-}
-
-// initNewMessage puts msg in the message queue and allocates resources for tracking it
-//
-// TODO: generate unique message id internally
-// TODO: use mutex to avoid data races (though such races have impact
-//          only for delay of including message in the processing)            DONE
-func (p *nodeProcessor) initNewMessage(msg Message, netSize, curCounter int) (exists bool) {
-	existingID := func(msgId int) bool {
-		for _, val := range p.msgIDs {
-			if val == msgId {
-				return true
-			}
-		}
-		return false
+		neighbours: neighbours,
+		nodes:      nodes,
+		msgIDs:     newSeenCache(cfg),
+		ackIDs:     newSeenCache(cfg),
+		store:      newMessageStore(cfg.SeenCapacity),
+		members:    newMembership(neighbours),
+		tree:       newPlumtree(neighbours),
+		sampling:   newSampling(),
+		aggregates: make(map[string]*aggregate),
+		state:      newKVState(),
+		crdts:      make(map[string]CRDT),
+		states:     make(map[stateKey]*partialState),
+		msgQueue:   newMessageQueue(rng, cfg.Fanout, cfg.PeerSelection),
+		ackQueue:   newMessageQueue(rng, cfg.Fanout, cfg.PeerSelection),
+		acks:       make(map[MsgID]map[int]bool),
+		waiting:    make(map[MsgID]int),
+		rumours:    make(map[MsgID]*Rumour),
+		partial:    make(map[MsgID]*partialMessage),
+		rng:        rng,
+		cfg:        cfg,
 	}
+}
 
-	getDestList := func() []int {
-		res := make([]int, 0, len(p.neighbours))
-		for key := range p.neighbours {
-			res = append(res, key)
-		}
-		return res
+// seed replaces the processor's source of randomness with a seeded one.
+func (p *nodeProcessor) seed(seed int64) {
+	p.rng = rand.New(rand.NewSource(seed))
+	p.msgQueue.rng = p.rng
+	p.ackQueue.rng = p.rng
+}
+
+// setNodes sets IDs of all nodes of the net.
+func (p *nodeProcessor) setNodes(ids []int) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.nodes = make(map[int]bool, len(ids))
+	for _, id := range ids {
+		p.nodes[id] = true
 	}
+}
+
+// addNode lets the node know about the new node with id.
+func (p *nodeProcessor) addNode(id int) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.nodes[id] = true
+}
 
+// initNewMessage puts msg in the message queue and in the inbox
+// and allocates resources for tracking it.
+// msg has to have an ID generated by the node. It's tracked until all nodes
+// known at the moment which are still in the net and not dead acked it.
+// A large message is queued as chunks which are given to the processor too.
+func (p *nodeProcessor) initNewMessage(msg Message, chunks []Message, curCounter int, r *Rumour) {
 	msgId := msg.ID
-	if !existingID(msgId) { // If such msgId is already known to this node then error is generated
-		                    // but it doesn't garantee that there are no such msgId in the whole Net.
-		                    // If it's already exists it will be ignored by nodes or can be processed
-		                    // incorrectly.
-		p.m.Lock()
-		p.acks[msgId] = make([]bool, netSize)
-		p.acks[msgId][p.myID] = true
-		p.msgIDs = append(p.msgIDs, msgId)
-		p.msgQueue.putMessage(msg, getDestList())
-		p.waiting[msgId] = curCounter
-		p.m.Unlock()
-		logger.Printf("[NODE %d] new message inited: %s", p.myID, msg)
-		return false
-	}
-	return true
+	p.m.Lock()
+	p.acks[msgId] = make(map[int]bool, len(p.nodes))
+	for id := range p.nodes {
+		p.acks[msgId][id] = false
+	}
+	p.acks[msgId][p.myID] = true
+	p.msgIDs.add(seenKey{msgId, -1}, curCounter)
+	if chunks == nil {
+		chunks = []Message{msg}
+	}
+	for _, chunk := range chunks {
+		if chunk.ID != msgId {
+			p.msgIDs.add(seenKey{chunk.ID, -1}, curCounter)
+		}
+		p.store.put(chunk)
+		if p.cfg.Plumtree {
+			p.treePush(chunk, p.myID)
+		} else {
+			p.msgQueue.putMessage(chunk, p.getNeighbours(), p.cfg.TTL)
+		}
+	}
+	p.waiting[msgId] = curCounter
+	p.rumours[msgId] = r
+	p.inbox = append(p.inbox, msg) // delivered to the node's subscribers by its goroutine
+	p.cfg.Logger.Printf("[NODE %d] new message inited: %s", p.myID, msg)
+	p.checkAcked(msgId, curCounter) // no other node may have to ack it
+	p.m.Unlock()
 }
 
+// processMsg processes a received message or every message of a batch.
 func (p *nodeProcessor) processMsg(msg Message, curCount int) {
-	alreadyReceivedMsg := func(id int) bool {
-		for _, val := range p.msgIDs {
-			if val == id {
-				return true
-			}
-		}
-		return false
+	p.m.Lock()
+	defer p.m.Unlock()
+	if msg.MsgType != "batch" {
+		p.processOne(msg, curCount)
+		return
+	}
+	p.applyUpdates(msg.Members, curCount)
+	for _, m := range msg.Batch {
+		p.processOne(m, curCount)
 	}
+}
 
-	alreadyReceivedAck := func(msgId, nodeId int) bool {
-		_, hasKey := p.ackIDs[msgId]
-		if hasKey {
-			for _, val := range p.ackIDs[msgId] {
-				if val == nodeId {
-					return true
-				}
-			}
-		}
-		return false
+// processOne processes a message, p.m has to be locked.
+func (p *nodeProcessor) processOne(msg Message, curCount int) {
+	alreadyReceivedMsg := func(id MsgID) bool {
+		return p.msgIDs.has(seenKey{id, -1}, curCount)
 	}
 
-	memorizeMsgID := func(id int) {
-		p.msgIDs = append(p.msgIDs, id)
+	alreadyReceivedAck := func(msgId MsgID, nodeId int) bool {
+		return p.ackIDs.has(seenKey{msgId, nodeId}, curCount)
 	}
 
-	memorizeAckID := func(msgId, nodeId int) {
-		_, hasKey := p.ackIDs[msgId]
+	memorizeMsgID := func(id MsgID) {
+		p.msgIDs.add(seenKey{id, -1}, curCount)
+	}
 
-		if !hasKey {
-			p.ackIDs[msgId] = make([]int, 1, 10)
-			p.ackIDs[msgId][0] = nodeId
-		} else {
-			p.ackIDs[msgId] = append(p.ackIDs[msgId], nodeId)
-		}
+	memorizeAckID := func(msgId MsgID, nodeId int) {
+		p.ackIDs.add(seenKey{msgId, nodeId}, curCount)
 	}
 
 	const (
@@ -134,105 +183,277 @@ func (p *nodeProcessor) processMsg(msg Message, curCount int) {
 
 	getDestList := func(mode int) []int {
 		res := make([]int, 0, len(p.neighbours))
-		if mode == 0 {
-			for key := range p.neighbours {
+		for key := range p.neighbours {
+			if p.reachable(key) && (mode == ALL || key != msg.Sender) {
 				res = append(res, key)
 			}
-		} else {
-			for key := range p.neighbours {
-				if key != msg.Sender {
-					res = append(res, key)
-				}
-			}
 		}
+		sort.Ints(res) // keep the order independent of map iteration
 		return res
 	}
 
-	initedByMe := func(msgId int) bool {
+	initedByMe := func(msgId MsgID) bool {
 		_, flag := p.waiting[msgId]
 		return flag
 	}
 
-	writeAck := func(msgId, nodeId int) {
-		p.acks[msgId][nodeId] = true
+	stillTracked := func(msgId MsgID) bool {
+		_, flag := p.acks[msgId]
+		return flag
 	}
 
-	ackedByAll := func(msgId int) bool {
-		for _, val := range p.acks[msgId] {
-			if !val {
-				return false
-			}
+	writeAck := func(msgId MsgID, nodeId int) {
+		if _, ok := p.acks[msgId][nodeId]; ok { // nodes added later are not waited for
+			p.acks[msgId][nodeId] = true
 		}
-		return true
 	}
 
-	getWaitInterval := func(msgId int) int {
-		return (curCount - p.waiting[msgId])
-	}
-
-	deleteTrack := func(msgId int) {
-		delete(p.acks, msgId)
-	}
-
-	boolSliceToString := func(values []bool) string {
+	boolMapToString := func(values map[int]bool) string {
+		ids := make([]int, 0, len(values))
+		for id := range values {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
 		valuesText := []string{}
-		for _, val := range values {
-			text := strconv.FormatBool(val)
+		for _, id := range ids {
+			text := strconv.Itoa(id) + ":" + strconv.FormatBool(values[id])
 			valuesText = append(valuesText, text)
 		}
 		return "[ " + strings.Join(valuesText, " ") + " ]"
 	}
 
-	if msg.MsgType == "multicast" {
+	p.applyUpdates(msg.Members, curCount)
+	switch msg.MsgType {
+	case "multicast":
 		if !alreadyReceivedMsg(msg.ID) {
 			memorizeMsgID(msg.ID)
-			p.msgQueue.putMessage(Message{msg.ID, "multicast", p.myID, msg.Origin, msg.Data}, getDestList(EXCEPTSENDER))
-			p.ackQueue.putMessage(Message{msg.ID, "notification", p.myID, p.myID, "ack"}, getDestList(ALL))
+			fwd := NewMessage(msg.ID, "multicast", p.myID, msg.Origin, msg.Data)
+			fwd.Chunk = msg.Chunk
+			p.store.put(fwd)
+			if p.cfg.Plumtree {
+				p.treePush(fwd, msg.Sender)
+			} else {
+				p.msgQueue.putMessage(fwd, getDestList(EXCEPTSENDER), p.cfg.TTL)
+			}
+			whole, complete := msg, true
+			if msg.Chunk != nil { // the whole message is delivered and acked
+				whole, complete = p.addChunk(msg, curCount)
+				complete = complete && !alreadyReceivedMsg(whole.ID)
+				if complete {
+					memorizeMsgID(whole.ID)
+				}
+			}
+			if complete {
+				p.inbox = append(p.inbox, whole)
+				p.ackQueue.putMessage(NewMessage(whole.ID, "notification", p.myID, p.myID, "ack"), getDestList(ALL), p.cfg.TTL)
+			}
+		} else if p.cfg.Plumtree {
+			p.pruneSender(msg)
 		}
-	} else { // msg.MsgType == "notification" {
+	case "digest":
+		p.processDigest(msg, curCount)
+	case "pull":
+		p.processPull(msg)
+	case "ping", "ping-req", "ping-ack":
+		p.processProbe(msg, curCount)
+	case "ihave", "graft", "prune":
+		p.processTree(msg, curCount)
+	case "join", "forward-join", "neighbour", "neighbour-accept", "neighbour-reject", "disconnect", "shuffle", "shuffle-reply":
+		p.processSampling(msg)
+	case "aggregate":
+		p.processAggregate(msg)
+	case "state-digest", "state-reply", "state-delta":
+		p.processState(msg)
+	case "crdt":
+		p.processCRDT(msg, curCount)
+	case "notification":
 		if !alreadyReceivedAck(msg.ID, msg.Origin) {
 			memorizeAckID(msg.ID, msg.Origin)
-			if initedByMe(msg.ID) {
+			if initedByMe(msg.ID) && stillTracked(msg.ID) { // acks can come again after the cache forgets them
 				writeAck(msg.ID, msg.Origin)
-				logger.Printf("[NODE %d] [MESSAGE %d ACKED BY NODE %d] acks for message: %s \n", p.myID, msg.ID, msg.Origin, boolSliceToString(p.acks[msg.ID]))
-				if ackedByAll(msg.ID) {
-					dur := getWaitInterval(msg.ID)
-					logger.Printf("[NODE %d] [MESSAGE %d ACKED BY ALL NODES] time passed %d\n", p.myID, msg.ID, dur)
-					deleteTrack(msg.ID)
-					if testMode {
-						feedback <- dur
-					}
-				}
+				p.cfg.Logger.Printf("[NODE %d] [MESSAGE %s ACKED BY NODE %d] acks for message: %s \n", p.myID, msg.ID, msg.Origin, boolMapToString(p.acks[msg.ID]))
+				p.checkAcked(msg.ID, curCount)
 			}
-			p.msgQueue.putMessage(Message{msg.ID, "notification", p.myID, msg.Origin, msg.Data}, getDestList(EXCEPTSENDER))
+			p.msgQueue.putMessage(NewMessage(msg.ID, "notification", p.myID, msg.Origin, msg.Data), getDestList(EXCEPTSENDER), p.cfg.TTL)
 		}
 	}
 }
 
-func (p *nodeProcessor) getRandomMsg() (Message, *net.UDPAddr, bool) {
-	getAddr := func(id int) *net.UDPAddr {
-		return p.neighbours[id]
+// checkAcked stops tracking the message made by the node if it's acked
+// by all nodes except dead ones and queues the call of the config's OnAcked.
+func (p *nodeProcessor) checkAcked(msgId MsgID, curCount int) {
+	for id, val := range p.acks[msgId] {
+		if !val && p.reachable(id) {
+			return
+		}
+	}
+	dur := curCount - p.waiting[msgId]
+	p.cfg.Logger.Printf("[NODE %d] [MESSAGE %s ACKED BY ALL NODES] time passed %d\n", p.myID, msgId, dur)
+	if r := p.rumours[msgId]; r != nil {
+		r.complete(p.acks[msgId], dur)
+	}
+	delete(p.rumours, msgId)
+	delete(p.acks, msgId)
+	if p.cfg.OnAcked != nil {
+		p.acked = append(p.acked, ackedMessage{msgId, dur})
 	}
+}
 
+// addNeighbour connects the node to the new node with id.
+func (p *nodeProcessor) addNeighbour(id int, addr string) {
 	p.m.Lock()
-	msg, nodeId, empty := p.msgQueue.getMessage()
-	p.m.Unlock()
-	if empty {
-		return Message{}, nil, true
-	} else {
-		return msg, getAddr(nodeId), false
+	defer p.m.Unlock()
+	p.neighbours[id] = addr
+	p.members.members[id] = &member{state: MemberAlive}
+	p.tree.setEager(id)
+}
+
+// removeNeighbour disconnects the node from the node with id which left the net.
+func (p *nodeProcessor) removeNeighbour(id int) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.disconnect(id)
+	delete(p.members.members, id)
+	delete(p.sampling.passive, id)
+}
+
+// forgetNode stops waiting for acks of the node with id which left the net.
+// Messages acked by all the other nodes are completed.
+func (p *nodeProcessor) forgetNode(id int, curCount int) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	delete(p.nodes, id)
+	for _, acks := range p.acks {
+		delete(acks, id)
 	}
+	p.checkAllAcked(curCount)
 }
 
-func (p *nodeProcessor) getRandomAck() (Message, *net.UDPAddr, bool) {
-	getAddr := func(id int) *net.UDPAddr {
-		return p.neighbours[id]
+// checkAllAcked completes all messages made by the node which are acked
+// by all nodes, after membership of the net changed.
+func (p *nodeProcessor) checkAllAcked(curCount int) {
+	tracked := make([]MsgID, 0, len(p.acks))
+	for msgId := range p.acks {
+		tracked = append(tracked, msgId)
 	}
+	sort.Slice(tracked, func(i, j int) bool { return tracked[i].Seq < tracked[j].Seq })
+	for _, msgId := range tracked {
+		p.checkAcked(msgId, curCount)
+	}
+}
+
+// getNeighbours returns sorted IDs of the node's neighbours which are not dead.
+func (p *nodeProcessor) getNeighbours() []int {
+	res := make([]int, 0, len(p.neighbours))
+	for key := range p.neighbours {
+		if p.reachable(key) {
+			res = append(res, key)
+		}
+	}
+	sort.Ints(res) // keep the order independent of map iteration
+	return res
+}
+
+// outPack is a message the processor sends to the node with id to
+// or to addr if the node isn't a neighbour.
+type outPack struct {
+	to   int
+	addr string
+	msg  Message
+}
+
+// sendTo puts msg to the outbox, the node sends it after
+// the current message or round is processed.
+func (p *nodeProcessor) sendTo(to int, msg Message) {
+	p.outbox = append(p.outbox, outPack{to: to, msg: msg})
+}
 
-	msg, nodeId, empty := p.ackQueue.getMessage()
-	if empty {
-		return Message{}, nil, true
-	} else {
-		return msg, getAddr(nodeId), false
+// sendToAddr puts msg for a node which isn't a neighbour to the outbox.
+func (p *nodeProcessor) sendToAddr(addr string, msg Message) {
+	p.outbox = append(p.outbox, outPack{addr: addr, msg: msg})
+}
+
+// takeOutbox empties the outbox and returns its messages with addresses of recipients.
+func (p *nodeProcessor) takeOutbox() []senderPack {
+	p.m.Lock()
+	defer p.m.Unlock()
+	res := make([]senderPack, 0, len(p.outbox))
+	for _, pack := range p.outbox {
+		if pack.addr != "" {
+			res = append(res, senderPack{pack.msg, pack.addr})
+		} else if addr, ok := p.neighbours[pack.to]; ok {
+			res = append(res, senderPack{pack.msg, addr})
+		}
+	}
+	p.outbox = p.outbox[:0]
+	return res
+}
+
+// progress returns a copy of acks of the tracked message made by the node
+// or nil if the message isn't tracked.
+func (p *nodeProcessor) progress(msgId MsgID) map[int]bool {
+	p.m.Lock()
+	defer p.m.Unlock()
+	acks, ok := p.acks[msgId]
+	if !ok {
+		return nil
+	}
+	res := make(map[int]bool, len(acks))
+	for id, val := range acks {
+		res[id] = val
+	}
+	return res
+}
+
+// ackedMessage is a message made by the node which all nodes acked
+// in the given number of rounds.
+type ackedMessage struct {
+	id     MsgID
+	rounds int
+}
+
+// results are what the processor has for the application after processing:
+// new messages, changes of replicated state, completed messages
+// and membership changes.
+type results struct {
+	inbox   []Message
+	changes []StateEntry
+	acked   []ackedMessage
+	events  []MemberEvent
+}
+
+// takeResults empties the inbox and queues of changes, completed messages and events.
+func (p *nodeProcessor) takeResults() results {
+	p.m.Lock()
+	defer p.m.Unlock()
+	res := results{p.inbox, p.state.changes, p.acked, p.events}
+	p.inbox, p.state.changes, p.acked, p.events = nil, nil, nil, nil
+	return res
+}
+
+// cacheStats returns metrics of both caches of already received messages and acks.
+func (p *nodeProcessor) cacheStats() CacheStats {
+	p.m.Lock()
+	defer p.m.Unlock()
+	s := p.msgIDs.getStats()
+	s.add(p.ackIDs.getStats())
+	return s
+}
+
+// getRoundMessages returns messages sent every round: a message
+// and an ack, each to recipients chosen by the queues.
+func (p *nodeProcessor) getRoundMessages() []senderPack {
+	p.m.Lock()
+	defer p.m.Unlock()
+	var res []senderPack
+	for _, q := range []*messageQueue{p.msgQueue, p.ackQueue} {
+		msg, recipients, empty := q.getMessage()
+		if empty {
+			continue
+		}
+		for _, id := range recipients {
+			res = append(res, senderPack{msg, p.neighbours[id]})
+		}
 	}
+	return res
 }
@@ -0,0 +1,20 @@
+package gossip
+
+import (
+	"testing"
+)
+
+func TestMessageWithoutAckers(t *testing.T) {
+	p := testProcessor(0, 1)
+	p.forgetNode(1, 0)
+	r := newRumour(MsgID{0, 1}, p, realClock{})
+	p.initNewMessage(NewMessage(MsgID{0, 1}, "multicast", 0, 0, "hello"), nil, 0, r)
+	select {
+	case <-r.Done():
+	default:
+		t.Fatal("message is not completed though no node has to ack it")
+	}
+	if acks := r.Progress(); len(acks) != 1 || !acks[0] {
+		t.Fatalf("acks %v, want only the node itself", acks)
+	}
+}
@@ -0,0 +1,122 @@
+package gossip
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Rumour is a handle of a message made by MakeRumour. It tracks acks
+// of the message until all nodes acked it.
+type Rumour struct {
+	id      MsgID
+	p       *nodeProcessor // processor of the node which made the message
+	clock   Clock
+	sim     *simulator // driven by Wait in simulation mode
+	start   time.Time
+	done    chan struct{}
+	m       sync.Mutex
+	acks    map[int]bool // final acks, set on completion
+	rounds  int
+	latency time.Duration
+}
+
+func newRumour(id MsgID, p *nodeProcessor, clock Clock) *Rumour {
+	r := &Rumour{
+		id:    id,
+		p:     p,
+		clock: clock,
+		start: clock.Now(),
+		done:  make(chan struct{}),
+	}
+	if sim, ok := clock.(*simulator); ok {
+		r.sim = sim
+	}
+	return r
+}
+
+// complete finishes tracking after the message is acked by all nodes.
+func (r *Rumour) complete(acks map[int]bool, rounds int) {
+	r.m.Lock()
+	r.acks = make(map[int]bool, len(acks))
+	for id, val := range acks {
+		r.acks[id] = val
+	}
+	r.rounds = rounds
+	r.latency = r.clock.Now().Sub(r.start)
+	r.m.Unlock()
+	close(r.done)
+}
+
+// ID returns the message ID.
+func (r *Rumour) ID() MsgID {
+	return r.id
+}
+
+// Done returns a channel which is closed when all nodes acked the message.
+func (r *Rumour) Done() <-chan struct{} {
+	return r.done
+}
+
+// Wait waits until all nodes ack the message or ctx is done.
+// In simulation mode it runs the simulation until then.
+func (r *Rumour) Wait(ctx context.Context) error {
+	if r.sim != nil {
+		for {
+			select {
+			case <-r.done:
+				return nil
+			default:
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if !r.sim.step(math.MaxInt64) {
+				return &errorString{"simulation has stopped"}
+			}
+		}
+	}
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Progress returns acks of the message: IDs of nodes which are waited
+// for and whether they acked it.
+func (r *Rumour) Progress() map[int]bool {
+	select {
+	case <-r.done:
+	default:
+		if res := r.p.progress(r.id); res != nil {
+			return res
+		}
+		<-r.done // completed right now
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	res := make(map[int]bool, len(r.acks))
+	for id, val := range r.acks {
+		res[id] = val
+	}
+	return res
+}
+
+// Rounds returns the number of rounds of the node which made the message
+// passed until all nodes acked it, or zero if it isn't acked yet.
+func (r *Rumour) Rounds() int {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.rounds
+}
+
+// Latency returns the time passed until all nodes acked the message,
+// or zero if it isn't acked yet. In simulation mode it's virtual time.
+func (r *Rumour) Latency() time.Duration {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.latency
+}
@@ -0,0 +1,224 @@
+package gossip
+
+import (
+	"container/list"
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+)
+
+const (
+	// defaultSeenCapacity is the capacity of seen caches if the config doesn't set it.
+	defaultSeenCapacity = 10000
+	// bloomFalsePositive is the false positive rate Bloom filters are sized for.
+	bloomFalsePositive = 0.01
+)
+
+// CacheStats are metrics of caches of already seen messages.
+type CacheStats struct {
+	Size        int // number of remembered keys
+	Lookups     int // number of checks whether a key was seen
+	Hits        int // number of checks answered positively
+	Evictions   int // keys forgotten because the cache was full
+	Expirations int // keys forgotten because they were too old
+	// FalsePositiveRate is the estimated probability that a check of an unseen key
+	// is answered positively. It is always zero for exact caches.
+	FalsePositiveRate float64
+}
+
+func (s *CacheStats) add(o CacheStats) {
+	s.Size += o.Size
+	s.Lookups += o.Lookups
+	s.Hits += o.Hits
+	s.Evictions += o.Evictions
+	s.Expirations += o.Expirations
+	s.FalsePositiveRate = math.Max(s.FalsePositiveRate, o.FalsePositiveRate)
+}
+
+// seenKey is a key of seen cache: a message ID and, for acks, the acking node.
+type seenKey struct {
+	id   MsgID
+	node int
+}
+
+type seenEntry struct {
+	key   seenKey
+	round int // round the key was added at
+}
+
+// seenCache remembers keys of already seen messages with O(1) lookup.
+// It holds at most capacity keys evicting the oldest ones and forgets
+// keys older than expiry rounds (if expiry is not zero).
+//
+// In Bloom mode keys are stored in two generations of Bloom filters:
+// new keys go to the current one and when it is full or expired,
+// the previous generation is forgotten as a whole.
+type seenCache struct {
+	capacity int
+	expiry   int
+	entries  map[seenKey]*list.Element
+	order    *list.List // entries from the oldest to the newest
+	cur      *bloomFilter
+	prev     *bloomFilter
+	stats    CacheStats
+}
+
+func newSeenCache(cfg *Config) *seenCache {
+	c := &seenCache{
+		capacity: cfg.SeenCapacity,
+		expiry:   cfg.SeenExpiry,
+	}
+	if c.capacity <= 0 {
+		c.capacity = defaultSeenCapacity
+	}
+	if cfg.SeenBloom {
+		c.cur = newBloomFilter(c.capacity, bloomFalsePositive, 0)
+		c.prev = newBloomFilter(c.capacity, bloomFalsePositive, 0)
+	} else {
+		c.entries = make(map[seenKey]*list.Element)
+		c.order = list.New()
+	}
+	return c
+}
+
+// has reports whether key was seen. round is the current round of the node.
+func (c *seenCache) has(key seenKey, round int) bool {
+	ok := c.peek(key, round)
+	c.stats.Lookups++
+	if ok {
+		c.stats.Hits++
+	}
+	return ok
+}
+
+// peek is has which isn't counted in stats, for checks not made on receipt.
+func (c *seenCache) peek(key seenKey, round int) bool {
+	c.expire(round)
+	if c.cur != nil {
+		return c.cur.has(key) || c.prev.has(key)
+	}
+	_, ok := c.entries[key]
+	return ok
+}
+
+// add remembers key at round.
+func (c *seenCache) add(key seenKey, round int) {
+	c.expire(round)
+	if c.cur != nil {
+		if c.cur.count >= c.capacity {
+			c.stats.Evictions += c.prev.count
+			c.rotate(round)
+		}
+		c.cur.add(key)
+		return
+	}
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+	if c.order.Len() >= c.capacity {
+		oldest := c.order.Front()
+		delete(c.entries, oldest.Value.(seenEntry).key)
+		c.order.Remove(oldest)
+		c.stats.Evictions++
+	}
+	c.entries[key] = c.order.PushBack(seenEntry{key, round})
+}
+
+// expire forgets keys older than expiry rounds.
+func (c *seenCache) expire(round int) {
+	if c.expiry <= 0 {
+		return
+	}
+	if c.cur != nil {
+		// each generation lives expiry rounds, so keys live from expiry to 2*expiry rounds
+		if round-c.cur.born >= c.expiry {
+			c.stats.Expirations += c.prev.count
+			c.rotate(round)
+		}
+		return
+	}
+	for e := c.order.Front(); e != nil && round-e.Value.(seenEntry).round >= c.expiry; e = c.order.Front() {
+		delete(c.entries, e.Value.(seenEntry).key)
+		c.order.Remove(e)
+		c.stats.Expirations++
+	}
+}
+
+func (c *seenCache) rotate(round int) {
+	c.prev = c.cur
+	c.cur = newBloomFilter(c.capacity, bloomFalsePositive, round)
+}
+
+func (c *seenCache) getStats() CacheStats {
+	s := c.stats
+	if c.cur != nil {
+		s.Size = c.cur.count + c.prev.count
+		s.FalsePositiveRate = 1 - (1-c.cur.falsePositiveRate())*(1-c.prev.falsePositiveRate())
+	} else {
+		s.Size = c.order.Len()
+	}
+	return s
+}
+
+// bloomFilter is a set of keys with false positives.
+type bloomFilter struct {
+	bits  []uint64
+	m     uint64 // number of bits
+	k     int    // number of hash functions
+	count int    // number of added keys
+	born  int    // round the filter was made at
+}
+
+// newBloomFilter makes a filter for n keys with false positive rate p.
+func newBloomFilter(n int, p float64, round int) *bloomFilter {
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	k := int(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &bloomFilter{
+		bits: make([]uint64, (m+63)/64),
+		m:    m,
+		k:    k,
+		born: round,
+	}
+}
+
+// hashes returns two hashes of key for double hashing.
+func (f *bloomFilter) hashes(key seenKey) (uint64, uint64) {
+	var buf [24]byte
+	binary.LittleEndian.PutUint64(buf[0:], uint64(key.id.Node))
+	binary.LittleEndian.PutUint64(buf[8:], key.id.Seq)
+	binary.LittleEndian.PutUint64(buf[16:], uint64(key.node))
+	h := fnv.New64a()
+	h.Write(buf[:])
+	h1 := h.Sum64()
+	h.Write(buf[:])
+	h2 := h.Sum64() | 1
+	return h1, h2
+}
+
+func (f *bloomFilter) add(key seenKey) {
+	h1, h2 := f.hashes(key)
+	for i := 0; i < f.k; i++ {
+		bit := (h1 + uint64(i)*h2) % f.m
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+	f.count++
+}
+
+func (f *bloomFilter) has(key seenKey) bool {
+	h1, h2 := f.hashes(key)
+	for i := 0; i < f.k; i++ {
+		bit := (h1 + uint64(i)*h2) % f.m
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// falsePositiveRate estimates the false positive rate with the current number of keys.
+func (f *bloomFilter) falsePositiveRate() float64 {
+	return math.Pow(1-math.Exp(-float64(f.k)*float64(f.count)/float64(f.m)), float64(f.k))
+}
@@ -0,0 +1,103 @@
+package gossip
+
+import "testing"
+
+func seenCacheOf(capacity, expiry int, bloom bool) *seenCache {
+	cfg := testConfig()
+	cfg.SeenCapacity, cfg.SeenExpiry, cfg.SeenBloom = capacity, expiry, bloom
+	return newSeenCache(cfg)
+}
+
+func seqKey(seq int) seenKey {
+	return seenKey{MsgID{1, uint64(seq)}, -1}
+}
+
+func TestSeenCacheEvictsOldest(t *testing.T) {
+	c := seenCacheOf(3, 0, false)
+	for i := 0; i < 5; i++ {
+		c.add(seqKey(i), 0)
+		c.add(seqKey(i), 0) // adding again changes nothing
+	}
+	for i := 0; i < 5; i++ {
+		if got, want := c.has(seqKey(i), 0), i >= 2; got != want {
+			t.Fatalf("key %d seen = %v, want %v", i, got, want)
+		}
+	}
+	s := c.getStats()
+	if s.Size != 3 || s.Evictions != 2 || s.Expirations != 0 || s.Lookups != 5 || s.Hits != 3 || s.FalsePositiveRate != 0 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+}
+
+func TestSeenCacheExpires(t *testing.T) {
+	c := seenCacheOf(10, 3, false)
+	for i := 0; i < 4; i++ {
+		c.add(seqKey(i), i)
+	}
+	// at round 4 keys added at rounds 0 and 1 are 3 or more rounds old
+	for i := 0; i < 4; i++ {
+		if got, want := c.has(seqKey(i), 4), i >= 2; got != want {
+			t.Fatalf("key %d seen = %v, want %v", i, got, want)
+		}
+	}
+	if s := c.getStats(); s.Size != 2 || s.Expirations != 2 || s.Evictions != 0 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+}
+
+func TestBloomCacheRotates(t *testing.T) {
+	c := seenCacheOf(100, 0, true)
+	for i := 0; i < 100; i++ {
+		c.add(seqKey(i), 0)
+	}
+	if s := c.getStats(); s.Size != 100 || s.Evictions != 0 || s.FalsePositiveRate <= 0 || s.FalsePositiveRate > 2*bloomFalsePositive {
+		t.Fatalf("unexpected stats of a full filter %+v", s)
+	}
+	// the first filter becomes the previous generation and is still checked
+	for i := 100; i < 200; i++ {
+		c.add(seqKey(i), 0)
+	}
+	for i := 0; i < 200; i++ {
+		if !c.has(seqKey(i), 0) {
+			t.Fatalf("key %d of two last generations is forgotten", i)
+		}
+	}
+	if s := c.getStats(); s.Size != 200 || s.Evictions != 0 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+	// the third generation forgets the first one as a whole
+	c.add(seqKey(200), 0)
+	if s := c.getStats(); s.Size != 101 || s.Evictions != 100 {
+		t.Fatalf("unexpected stats after rotation %+v", s)
+	}
+	forgotten := 0
+	for i := 0; i < 100; i++ {
+		if !c.has(seqKey(i), 0) {
+			forgotten++
+		}
+	}
+	if forgotten < 90 {
+		t.Fatalf("only %d of 100 keys of the dropped generation are forgotten", forgotten)
+	}
+}
+
+func TestBloomCacheExpires(t *testing.T) {
+	c := seenCacheOf(100, 5, true)
+	c.add(seqKey(0), 0)
+	c.add(seqKey(1), 5) // the first generation is 5 rounds old and becomes the previous one
+	if !c.has(seqKey(0), 5) || !c.has(seqKey(1), 5) {
+		t.Fatal("keys younger than two generations are forgotten")
+	}
+	if s := c.getStats(); s.Expirations != 0 || s.Size != 2 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+	if c.has(seqKey(0), 10) {
+		t.Fatal("key older than two generations is seen")
+	}
+	if !c.has(seqKey(1), 10) {
+		t.Fatal("key of the previous generation is forgotten")
+	}
+	if s := c.getStats(); s.Expirations != 1 || s.Size != 1 || s.Evictions != 0 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+}
@@ -1,50 +1,36 @@
 package gossip
 
-import (
-	"encoding/json"
-	"net"
-	"time"
-)
-
-// Receiver is a non-blocking reader from UDP connection.
+// Receiver is a non-blocking reader from a Transport.
 // It has a seporate listening goroutine which puts received
-// data in the channel.
+// messages in the channel and reading errors in the error channel.
 type Receiver struct {
-	C       chan Message
-	kill    chan struct{}
-	udpConn *net.UDPConn
-	buffer  []byte
+	C         chan Message
+	Err       chan error
+	kill      chan struct{}
+	done      chan struct{}
+	transport Transport
 }
 
-// NewReceiver constracts a new Receiver object assosiated with udpConn.
-func NewReceiver(udpConn *net.UDPConn) *Receiver {
-	rcvr := &Receiver{make(chan Message, 100), make(chan struct{}), udpConn, make([]byte, 1024)}
+// NewReceiver constracts a new Receiver object assosiated with transport.
+func NewReceiver(transport Transport) *Receiver {
+	rcvr := &Receiver{make(chan Message, 100), make(chan error, 10), make(chan struct{}), make(chan struct{}), transport}
 	return rcvr
 }
 
 func (r *Receiver) startReceiver() {
-	timeout := time.Duration(100 * time.Millisecond)
+	defer close(r.done)
 	for {
 		select {
 		case <-r.kill:
 			return
-		default:
-			msg := Message{}
-			// set timeout for non-blocking in case of no messages
-			r.udpConn.SetReadDeadline(time.Now().Add(timeout))
-			n, _, err := r.udpConn.ReadFromUDP(r.buffer)
-			if err != nil {
-				if e, ok := err.(net.Error); !ok || !e.Timeout() {
-					panic(err)
-				} else {
-					continue
-				}
-			} else {
-				if n != 0 {
-					json.Unmarshal(r.buffer[:n], &msg)
-					r.C <- msg
-				}
+		case msg := <-r.transport.Recv():
+			select {
+			case r.C <- msg:
+			case <-r.kill:
+				return
 			}
+		case err := <-r.transport.Errors():
+			reportError(r.Err, err)
 		}
 	}
 }
@@ -54,42 +40,45 @@ func (r *Receiver) Start() {
 	go r.startReceiver()
 }
 
-// Stop sends stop signal to receiver
+// Stop stops the receiver and waits for its goroutine to exit
 func (r *Receiver) Stop() {
-	r.kill <- struct{}{}
+	close(r.kill)
+	<-r.done
 }
 
 type senderPack struct {
 	msg  Message
-	addr *net.UDPAddr
+	addr string
 }
 
-// Sender is a writer to UDP connection.It has a seporate
+// Sender is a writer to a Transport. It has a seporate
 // goroutine which gets task from a channel and sends it.
 // Task is a pair of message and its recipient address.
+// Sending errors are put in the error channel.
 type Sender struct {
-	C       chan senderPack
-	kill    chan struct{}
-	udpConn *net.UDPConn
-	buffer  []byte
+	C         chan senderPack
+	Err       chan error
+	kill      chan struct{}
+	done      chan struct{}
+	transport Transport
 }
 
-// NewSender constructs new sender object assosiated with udpConn.
-func NewSender(udpConn *net.UDPConn) *Sender {
-	sndr := &Sender{make(chan senderPack, 100), make(chan struct{}), udpConn, make([]byte, 0, 1024)}
+// NewSender constructs new sender object assosiated with transport.
+func NewSender(transport Transport) *Sender {
+	sndr := &Sender{make(chan senderPack, 100), make(chan error, 10), make(chan struct{}), make(chan struct{}), transport}
 	return sndr
 }
 
 func (s *Sender) startSender() {
+	defer close(s.done)
 	for {
 		select {
 		case <-s.kill:
 			return
 		case pack := <-s.C:
-			buffer, _ := json.Marshal(pack.msg)
-			_, err := s.udpConn.WriteToUDP(buffer, pack.addr)
+			err := s.transport.Send(pack.addr, pack.msg)
 			if err != nil {
-				_ = err
+				reportError(s.Err, err)
 			}
 		}
 	}
@@ -100,7 +89,16 @@ func (s *Sender) Start() {
 	go s.startSender()
 }
 
-// Stop sends stop signal to the sender
+// Stop stops the sender and waits for its goroutine to exit
 func (s *Sender) Stop() {
-	s.kill <- struct{}{}
+	close(s.kill)
+	<-s.done
+}
+
+// reportError puts err in c unless c is full, so I/O is never blocked by errors.
+func reportError(c chan error, err error) {
+	select {
+	case c <- err:
+	default:
+	}
 }
@@ -0,0 +1,174 @@
+package gossip
+
+import (
+	"container/heap"
+	"io"
+	"math/rand"
+	"time"
+)
+
+const (
+	// simLatency is the delivery time of every message in simulation mode.
+	simLatency = time.Millisecond
+)
+
+// simEpoch is the virtual time the simulation starts at.
+var simEpoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+type simEvent struct {
+	at  time.Duration
+	seq uint64 // order of events scheduled at the same time
+	f   func()
+}
+
+type simEventHeap []simEvent
+
+func (h simEventHeap) Len() int { return len(h) }
+func (h simEventHeap) Less(i, j int) bool {
+	if h[i].at == h[j].at {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].at < h[j].at
+}
+func (h simEventHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *simEventHeap) Push(x interface{}) { *h = append(*h, x.(simEvent)) }
+func (h *simEventHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// simulator is a discrete-event scheduler with a virtual clock.
+// All events run one by one in the goroutine which drives the simulation,
+// so the run is fully determined by the seed.
+type simulator struct {
+	now      time.Duration
+	seq      uint64
+	events   simEventHeap
+	rng      *rand.Rand
+	handlers map[string]func(Message) // map[addr]receiving node
+	peers    map[string]*simTransport
+}
+
+func newSimulator(seed int64) *simulator {
+	return &simulator{
+		rng:      rand.New(rand.NewSource(seed)),
+		handlers: make(map[string]func(Message)),
+		peers:    make(map[string]*simTransport),
+	}
+}
+
+// Now returns the virtual time.
+func (s *simulator) Now() time.Time {
+	return simEpoch.Add(s.now)
+}
+
+// AfterFunc schedules f to run after d of virtual time.
+func (s *simulator) AfterFunc(d time.Duration, f func()) func() bool {
+	stopped, fired := false, false
+	s.seq++
+	heap.Push(&s.events, simEvent{s.now + d, s.seq, func() {
+		if !stopped {
+			fired = true
+			f()
+		}
+	}})
+	return func() bool {
+		if stopped || fired {
+			return false
+		}
+		stopped = true
+		return true
+	}
+}
+
+// every schedules f to run with period d starting after phase.
+// f isn't run after stop is called.
+func (s *simulator) every(phase, d time.Duration, f func()) (stop func()) {
+	stopped := false
+	var tick func()
+	tick = func() {
+		if stopped {
+			return
+		}
+		f()
+		s.AfterFunc(d, tick)
+	}
+	s.AfterFunc(phase, tick)
+	return func() { stopped = true }
+}
+
+// step runs the next event. It returns false if the event
+// is later than deadline or there are no events.
+func (s *simulator) step(deadline time.Duration) bool {
+	if len(s.events) == 0 || s.events[0].at > deadline {
+		return false
+	}
+	e := heap.Pop(&s.events).(simEvent)
+	s.now = e.at
+	e.f()
+	return true
+}
+
+// Listen opens a simulated transport with address addr.
+// It can be used as a TransportFactory.
+func (s *simulator) Listen(addr string) (Transport, error) {
+	if _, busy := s.handlers[addr]; busy {
+		return nil, &errorString{"address " + addr + " is already in use"}
+	}
+	s.handlers[addr] = nil
+	t := &simTransport{addr: addr, sim: s}
+	s.peers[addr] = t
+	return t, nil
+}
+
+// simTransport schedules delivery of messages as simulator events.
+// Received messages are handed to the node directly, so Recv is never ready.
+// Sizes of messages are counted as if they were encoded with BinaryCodec.
+type simTransport struct {
+	trafficCounter
+	addr string
+	sim  *simulator
+}
+
+func (t *simTransport) Send(addr string, msg Message) error {
+	size := wireSize(BinaryCodec, msg)
+	t.sent(size)
+	t.sim.AfterFunc(simLatency, func() {
+		if h := t.sim.handlers[addr]; h != nil {
+			t.sim.peers[addr].received(size)
+			h(msg)
+		}
+	})
+	return nil
+}
+
+func (t *simTransport) Recv() <-chan Message {
+	return nil
+}
+
+func (t *simTransport) Errors() <-chan error {
+	return nil
+}
+
+func (t *simTransport) Close() error {
+	delete(t.sim.handlers, t.addr)
+	delete(t.sim.peers, t.addr)
+	return nil
+}
+
+// clockWriter stamps every log line with the time of clock,
+// so logs of a simulation do not depend on the wall clock.
+type clockWriter struct {
+	w     io.Writer
+	clock Clock
+}
+
+func (cw *clockWriter) Write(p []byte) (int, error) {
+	stamp := "TRACE:" + cw.clock.Now().Format("15:04:05.000") + " "
+	if _, err := io.WriteString(cw.w, stamp); err != nil {
+		return 0, err
+	}
+	return cw.w.Write(p)
+}
@@ -0,0 +1,47 @@
+package gossip
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"testing"
+	"time"
+
+	"gitlab.com/n-canter/graph"
+)
+
+// simLog runs a lossy simulation of g and returns its log.
+func simLog(t *testing.T, g graph.Graph, seed int64) []byte {
+	var buf bytes.Buffer
+	GN := InitNetFromGraph(g, 100*time.Millisecond, WithSimulation(seed), WithMembership(1, 3, 5),
+		func(GN *GossipNet) { GN.cfg.Logger = log.New(&clockWriter{&buf, GN.sim}, "", 0) })
+	GN.SetFaults(Faults{Drop: 0.2, Duplicate: 0.1, Delay: 50 * time.Millisecond})
+	if err := GN.Start(""); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := GN.MakeRumour(i, Message{MsgType: "multicast", Data: "hello"}); err != nil {
+			t.Fatal(err)
+		}
+		GN.Advance(time.Second)
+	}
+	GN.Advance(5 * time.Second)
+	if err := GN.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSimulationIsDeterministic(t *testing.T) {
+	g := graph.Generate(8, 1, 5, BASE_PORT)
+	first := simLog(t, g, 42)
+	if len(first) == 0 {
+		t.Fatal("simulation logged nothing")
+	}
+	if second := simLog(t, g, 42); !bytes.Equal(first, second) {
+		t.Fatal("logs of simulations with the same seed differ")
+	}
+	if other := simLog(t, g, 43); bytes.Equal(first, other) {
+		t.Fatal("logs of simulations with different seeds are the same")
+	}
+}
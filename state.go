@@ -0,0 +1,237 @@
+package gossip
+
+import "sort"
+
+const (
+	// defaultDeltaSize is the max number of entries in a delta
+	// if the config doesn't set it.
+	defaultDeltaSize = 100
+	// entryOverhead is the max size of an encoded entry besides its key and value.
+	entryOverhead = 32
+)
+
+// StateEntry is a key of the replicated state of a node with its value.
+// Versions of entries of a node grow with every Set of the node.
+type StateEntry struct {
+	Node    int    `json:"node"`
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	Version uint64 `json:"ver"`
+}
+
+// StateVersion is the max version of the state of a node
+// another node knows.
+type StateVersion struct {
+	Node    int    `json:"node"`
+	Version uint64 `json:"ver"`
+}
+
+// nodeState is the known state of a node: its latest entries
+// with versions up to max.
+type nodeState struct {
+	entries map[string]StateEntry
+	max     uint64
+}
+
+// kvState is the replicated key-value state known by a node. Nodes reconcile
+// it Scuttlebutt-style: a node sends a digest of max versions it knows per node
+// (state-digest), the neighbour answers with entries of greater versions and
+// its own digest (state-reply), and the node sends entries the neighbour lacks
+// (state-delta).
+type kvState struct {
+	nodes   map[int]*nodeState
+	changes []StateEntry // applied entries to notify watchers about
+}
+
+func newKVState() *kvState {
+	return &kvState{nodes: make(map[int]*nodeState)}
+}
+
+func (s *kvState) node(id int) *nodeState {
+	ns, ok := s.nodes[id]
+	if !ok {
+		ns = &nodeState{entries: make(map[string]StateEntry)}
+		s.nodes[id] = ns
+	}
+	return ns
+}
+
+// apply stores e if it's newer than the known entry.
+func (s *kvState) apply(e StateEntry) {
+	ns := s.node(e.Node)
+	if e.Version > ns.max {
+		ns.max = e.Version
+	}
+	if old, ok := ns.entries[e.Key]; ok && old.Version >= e.Version {
+		return
+	}
+	ns.entries[e.Key] = e
+	s.changes = append(s.changes, e)
+}
+
+// digest returns max known versions of states of nodes.
+func (s *kvState) digest() []StateVersion {
+	res := make([]StateVersion, 0, len(s.nodes))
+	for id, ns := range s.nodes {
+		res = append(res, StateVersion{id, ns.max})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Node < res[j].Node })
+	return res
+}
+
+// size returns the max size of the encoded entry.
+func (e StateEntry) size() int {
+	return len(e.Key) + len(e.Value) + entryOverhead
+}
+
+// delta returns at most n entries newer than versions of digest which take
+// at most budget bytes, in order of versions, so a cut delta leaves no gaps
+// in the receiver's state.
+func (s *kvState) delta(digest []StateVersion, n, budget int) []StateEntry {
+	known := make(map[int]uint64, len(digest))
+	for _, v := range digest {
+		known[v.Node] = v.Version
+	}
+	res := []StateEntry{}
+	for id, ns := range s.nodes {
+		if ns.max <= known[id] {
+			continue
+		}
+		for _, e := range ns.entries {
+			if e.Version > known[id] {
+				res = append(res, e)
+			}
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Version < res[j].Version || res[i].Version == res[j].Version && res[i].Node < res[j].Node
+	})
+	size := 0
+	for i, e := range res {
+		size += e.size()
+		if i == n || size > budget {
+			return res[:i]
+		}
+	}
+	return res
+}
+
+func (cfg *Config) stateEvery() int {
+	if cfg.StateEvery > 0 {
+		return cfg.StateEvery
+	}
+	return 1
+}
+
+func (p *nodeProcessor) deltaSize() int {
+	if p.cfg.DeltaSize > 0 {
+		return p.cfg.DeltaSize
+	}
+	return defaultDeltaSize
+}
+
+// set changes the value of key of the node's own state.
+// An entry which doesn't fit in a delta is rejected.
+func (p *nodeProcessor) set(key, value string) (StateEntry, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if (StateEntry{Key: key, Value: value}).size() > p.cfg.chunkSize() {
+		return StateEntry{}, &errorString{"state entry is too large"}
+	}
+	ns := p.state.node(p.myID)
+	ns.max++
+	e := StateEntry{p.myID, key, value, ns.max}
+	ns.entries[key] = e
+	return e, nil
+}
+
+func (p *nodeProcessor) get(node int, key string) (string, bool) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	ns, ok := p.state.nodes[node]
+	if !ok {
+		return "", false
+	}
+	e, ok := ns.entries[key]
+	return e.Value, ok
+}
+
+// stateRound starts reconciliation with a random neighbour if the node knows any state.
+func (p *nodeProcessor) stateRound() {
+	p.m.Lock()
+	defer p.m.Unlock()
+	dests := p.getNeighbours()
+	if len(p.state.nodes) == 0 || len(dests) == 0 {
+		return
+	}
+	to := dests[p.rng.Intn(len(dests))]
+	p.sendTo(to, Message{MsgType: "state-digest", Sender: p.myID, Origin: p.myID, Versions: p.state.digest()})
+}
+
+// processState handles messages of state reconciliation.
+func (p *nodeProcessor) processState(msg Message) {
+	switch msg.MsgType {
+	case "state-digest":
+		p.sendTo(msg.Sender, Message{
+			MsgType:  "state-reply",
+			Sender:   p.myID,
+			Origin:   p.myID,
+			Entries:  p.state.delta(msg.Versions, p.deltaSize(), p.cfg.chunkSize()),
+			Versions: p.state.digest(),
+		})
+	case "state-reply", "state-delta":
+		for _, e := range msg.Entries {
+			if e.Node != p.myID {
+				p.state.apply(e)
+			}
+		}
+		if msg.MsgType == "state-delta" {
+			return
+		}
+		if entries := p.state.delta(msg.Versions, p.deltaSize(), p.cfg.chunkSize()); len(entries) > 0 {
+			p.sendTo(msg.Sender, Message{MsgType: "state-delta", Sender: p.myID, Origin: p.myID, Entries: entries})
+		}
+	}
+}
+
+// Set changes the value of key in the node's replicated state.
+// Other nodes get it by reconciliation with their neighbours.
+// Key and value have to fit in a message: they may take up to
+// the config's ChunkSize bytes less a few bytes of the entry's header.
+func (gn *GossipNode) Set(key, value string) error {
+	e, err := gn.processor.set(key, value)
+	if err != nil {
+		return err
+	}
+	gn.notify([]StateEntry{e})
+	return nil
+}
+
+// Get returns the value of key in the state of the node with id as known by this node.
+func (gn *GossipNode) Get(node int, key string) (string, bool) {
+	return gn.processor.get(node, key)
+}
+
+// Watch makes the node call f with every change of the replicated state
+// it learns about, including its own changes. f is called from the node's
+// goroutine or from the goroutine calling Set and must not block.
+func (gn *GossipNode) Watch(f func(StateEntry)) {
+	gn.m.Lock()
+	gn.watchers = append(gn.watchers, f)
+	gn.m.Unlock()
+}
+
+// notify hands state changes to watchers.
+func (gn *GossipNode) notify(changes []StateEntry) {
+	if len(changes) == 0 {
+		return
+	}
+	gn.m.Lock()
+	watchers := gn.watchers
+	gn.m.Unlock()
+	for _, e := range changes {
+		for _, f := range watchers {
+			f(e)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package gossip
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestStateDeltaFitsChunk(t *testing.T) {
+	p0, p1 := testProcessor(0, 1), testProcessor(1, 0)
+	cfg := p0.cfg
+	if _, err := p1.set("big", strings.Repeat("x", cfg.chunkSize())); err == nil {
+		t.Fatal("entry larger than a chunk is accepted")
+	}
+	for i := 0; i < 100; i++ {
+		if _, err := p1.set(fmt.Sprintf("key%d", i), strings.Repeat("x", 900)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p0.set("key", "value")
+	known := func() int {
+		if ns, ok := p0.state.nodes[1]; ok {
+			return len(ns.entries)
+		}
+		return 0
+	}
+	// exchange messages until node 0 knows the whole state of node 1
+	for round := 0; round < 200 && known() < 100; round++ {
+		p0.stateRound()
+		from, to := p0, p1
+		for msgs := from.takeOutbox(); len(msgs) > 0; msgs = from.takeOutbox() {
+			for _, pack := range msgs {
+				size := 0
+				for _, e := range pack.msg.Entries {
+					size += e.size()
+				}
+				if size > cfg.chunkSize() {
+					t.Fatalf("%s with entries of %d bytes, chunk size is %d", pack.msg.MsgType, size, cfg.chunkSize())
+				}
+				to.processMsg(pack.msg, round)
+			}
+			from, to = to, from
+		}
+	}
+	if n := known(); n != 100 {
+		t.Fatalf("node 0 knows %d of 100 entries", n)
+	}
+}
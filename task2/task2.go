@@ -1,11 +1,10 @@
 package main
 
 import (
+	"context"
 	"strconv"
-	"bytes"
     "fmt"
     "os"
-    "os/exec"
     "path/filepath"
 	"time"
     
@@ -24,9 +23,24 @@ func main() {
     }
     logDir := os.Args[1]
     dataDir := os.Args[2]
+    // optional seed runs experiments in simulation mode
+    var opts func() []gossip.Option
+    if len(os.Args) > 3 {
+        seed, err := strconv.ParseInt(os.Args[3], 10, 64)
+        if err != nil {
+            fmt.Println("Seed must be an integer")
+            return
+        }
+        opts = func() []gossip.Option {
+            seed++
+            return []gossip.Option{gossip.WithSimulation(seed)}
+        }
+    } else {
+        opts = func() []gossip.Option { return nil }
+    }
     dataFile := "test_loss.data"
     g := graph.Generate(50, 5, 7, 9080)
-    probabilities := []string{"0.1", "0.2", "0.3", "0.4", "0.5"}
+    probabilities := []string{"0.0", "0.1", "0.2", "0.3", "0.4", "0.5"}
     datafile, err := os.OpenFile(filepath.Join(dataDir, dataFile), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
     if err != nil {
         fmt.Println("Can't open data file")
@@ -35,74 +49,34 @@ func main() {
     defer datafile.Close()
     fmt.Println("Start collecting data, wait please")
     datafile.WriteString("10\n")
-    datafile.WriteString("0.0\n")
-    fmt.Print("Probability 0.0 ...")
-    for i:= 0; i < nExperiments; i++ {
-        doOneTest(g, logDir, datafile)
-        fmt.Print(".....")
-    }
-    datafile.WriteString("\n")
-    fmt.Println("")
     for _, p := range probabilities {
-        if !ruleProbability(p, false) {
-            break
-        }
+        loss, _ := strconv.ParseFloat(p, 64)
         datafile.WriteString(p + "\n")
         fmt.Print("Probability ", p, " ...")
         for i := 0; i < nExperiments; i++ {
-            doOneTest(g, logDir, datafile)
+            doOneTest(g, logDir, datafile, loss, opts()...)
             fmt.Print(".....")
         }
         datafile.WriteString("\n")
         fmt.Println("")
-        ruleProbability(p, true)
-    }
-}
-
-func ruleProbability(p string, toDel bool) bool {
-    cmdArgs :=  []string{"-A", "INPUT", "-p", "udp", "-i", "lo", "-m", "statistic", 
-							"--mode", "random", "--probability", "0.0", "-j", "DROP"} 
-							// 0, 11 is variable
-    var out bytes.Buffer
-    var er bytes.Buffer
-    if toDel {
-        cmdArgs[0] = "-D"
-    }
-    cmdArgs[11] = p
-    cmd := exec.Command("iptables", cmdArgs...)
-    out.Reset()
-    er.Reset()
-    cmd.Stdout = &out
-    cmd.Stderr = &er
-    cmd.Run()
-    if er.Len() > 0 {
-        fmt.Println(er.String())
-        return false
     }
-    return true
 }
 
-func doOneTest(g graph.Graph, logDir string, datafile *os.File) {
-    gossipNet := gossip.InitNetFromGraph(g, 100 * time.Millisecond)
-    feedback := gossipNet.SetTestMode()
+func doOneTest(g graph.Graph, logDir string, datafile *os.File, loss float64, opts ...gossip.Option) {
+    gossipNet := gossip.InitNetFromGraph(g, 100 * time.Millisecond, opts...)
     gossipNet.SetTTL(100)
-    gossipNet.Start(logDir)
+    gossipNet.SetFaults(gossip.Faults{Drop: loss})
+    if err := gossipNet.Start(logDir); err != nil {
+        fmt.Println("Can't start the net:", err)
+        os.Exit(1)
+    }
     msg := gossip.Message{
-        ID:        1,
         MsgType:   "multicast",
-        Sender:    0,
-        Origin:    0,
         Data:      "initial message",
     } 
-    gossipNet.MakeRumour(0, msg)
-    var n int
-    Loop:
-    for {
-        select {
-        case n = <-feedback:
-            break Loop
-        }
-    }
-    gossipNet.Stop()
-    datafile.WriteString(strconv.Itoa(n) + " ")
+    rumour, _ := gossipNet.MakeRumour(0, msg)
+    // runs the simulation if the net is simulated
+    rumour.Wait(context.Background())
+    gossipNet.Stop(context.Background())
+    datafile.WriteString(strconv.Itoa(rumour.Rounds()) + " ")
 }
@@ -0,0 +1,217 @@
+package gossip
+
+import (
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Transport is a carrier of messages between gossip nodes.
+// Peers are addressed by strings, e.g. "127.0.0.1:9080" for UDP.
+type Transport interface {
+	// Send delivers msg to the peer with address addr.
+	// Delivery is not guaranteed.
+	Send(addr string, msg Message) error
+	// Recv returns the channel of incoming messages.
+	Recv() <-chan Message
+	// Errors returns the channel of receiving errors.
+	// It is nil if receiving can't fail.
+	Errors() <-chan error
+	// Close releases transport resources.
+	Close() error
+}
+
+// TransportFactory opens a transport listening on addr.
+type TransportFactory func(addr string) (Transport, error)
+
+// nodeAddr returns the address of the node with port on host.
+func nodeAddr(host string, port int) string {
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// maxDatagramSize is the max size of UDP payload.
+const maxDatagramSize = 65507
+
+// TransportStats are counters of a transport.
+type TransportStats struct {
+	DecodeErrors    int // number of received malformed packets
+	PacketsSent     int
+	BytesSent       int
+	PacketsReceived int
+	BytesReceived   int
+}
+
+func (s *TransportStats) add(o TransportStats) {
+	s.DecodeErrors += o.DecodeErrors
+	s.PacketsSent += o.PacketsSent
+	s.BytesSent += o.BytesSent
+	s.PacketsReceived += o.PacketsReceived
+	s.BytesReceived += o.BytesReceived
+}
+
+// trafficCounter counts packets and bytes of a transport, it's safe for concurrent use.
+type trafficCounter struct {
+	decodeErrors, packetsSent, bytesSent, packetsReceived, bytesReceived int64
+}
+
+func (c *trafficCounter) sent(n int) {
+	atomic.AddInt64(&c.packetsSent, 1)
+	atomic.AddInt64(&c.bytesSent, int64(n))
+}
+
+func (c *trafficCounter) received(n int) {
+	atomic.AddInt64(&c.packetsReceived, 1)
+	atomic.AddInt64(&c.bytesReceived, int64(n))
+}
+
+// Stats returns counters of the transport.
+func (c *trafficCounter) Stats() TransportStats {
+	return TransportStats{
+		DecodeErrors:    int(atomic.LoadInt64(&c.decodeErrors)),
+		PacketsSent:     int(atomic.LoadInt64(&c.packetsSent)),
+		BytesSent:       int(atomic.LoadInt64(&c.bytesSent)),
+		PacketsReceived: int(atomic.LoadInt64(&c.packetsReceived)),
+		BytesReceived:   int(atomic.LoadInt64(&c.bytesReceived)),
+	}
+}
+
+// statsTransport is a Transport which counts its traffic.
+type statsTransport interface {
+	Stats() TransportStats
+}
+
+// UDPTransport is a Transport over UDP connection, one message per datagram.
+// Messages are encoded with BinaryCodec unless other codec is set,
+// both binary and JSON messages are received.
+type UDPTransport struct {
+	trafficCounter
+	conn   *net.UDPConn
+	codec  Codec
+	c      chan Message
+	errs   chan error
+	closed chan struct{}
+	done   chan struct{} // closed when reading goroutine exits
+	buffer []byte
+}
+
+// NewUDPTransport binds a socket on addr and starts reading from it.
+func NewUDPTransport(addr string) (Transport, error) {
+	return newUDPTransport(addr, BinaryCodec)
+}
+
+// UDPTransportWith returns the factory of UDP transports which encode messages with codec.
+func UDPTransportWith(codec Codec) TransportFactory {
+	return func(addr string) (Transport, error) {
+		return newUDPTransport(addr, codec)
+	}
+}
+
+func newUDPTransport(addr string, codec Codec) (Transport, error) {
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	t := &UDPTransport{
+		conn:   conn,
+		codec:  codec,
+		c:      make(chan Message, 100),
+		errs:   make(chan error, 10),
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+		buffer: make([]byte, maxDatagramSize),
+	}
+	go t.read()
+	return t, nil
+}
+
+func (t *UDPTransport) read() {
+	defer close(t.done)
+	timeout := time.Duration(100 * time.Millisecond)
+	for {
+		select {
+		case <-t.closed:
+			return
+		default:
+			// set timeout for non-blocking in case of no messages
+			t.conn.SetReadDeadline(time.Now().Add(timeout))
+			n, _, err := t.conn.ReadFromUDP(t.buffer)
+			if err != nil {
+				select {
+				case <-t.closed:
+					return
+				default:
+				}
+				if e, ok := err.(net.Error); !ok || !e.Timeout() {
+					t.reportError(err)
+				}
+				continue
+			}
+			if n != 0 {
+				t.received(n)
+				msg, err := decode(t.buffer[:n])
+				if err == errUnknownType {
+					continue // sent by a newer build
+				}
+				if err != nil {
+					atomic.AddInt64(&t.decodeErrors, 1)
+					t.reportError(err)
+					continue
+				}
+				select {
+				case t.c <- msg:
+				case <-t.closed:
+					return
+				}
+			}
+		}
+	}
+}
+
+// reportError reports err but doesn't block reading if nobody listens.
+func (t *UDPTransport) reportError(err error) {
+	select {
+	case t.errs <- err:
+	default:
+	}
+}
+
+// Send encodes msg and writes it to addr.
+func (t *UDPTransport) Send(addr string, msg Message) error {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	buffer, err := t.codec.Encode(msg)
+	if err != nil {
+		return err
+	}
+	if _, err = t.conn.WriteToUDP(buffer, raddr); err != nil {
+		return err
+	}
+	t.sent(len(buffer))
+	return nil
+}
+
+// Recv returns the channel of received messages.
+func (t *UDPTransport) Recv() <-chan Message {
+	return t.c
+}
+
+// Errors returns the channel of reading errors.
+// Errors are dropped if the channel is full.
+func (t *UDPTransport) Errors() <-chan error {
+	return t.errs
+}
+
+// Close stops reading, closes the socket and waits for the reading goroutine to exit.
+func (t *UDPTransport) Close() error {
+	close(t.closed)
+	err := t.conn.Close()
+	<-t.done
+	return err
+}